@@ -26,6 +26,14 @@ sqm_cake_mq_mode="${sqm_cake_mq_mode:-cake_mq}"
 # collector method
 sqm_collector="${sqm_collector:-shell}"
 sqm_go_collector_bin="${sqm_go_collector_bin:-/usr/lib/netdata/charts.d/sqm-go-collector}"
+sqm_go_state_file="${sqm_go_state_file-/tmp/sqm-go-collector.state}"
+sqm_go_plan_file="${sqm_go_plan_file-/tmp/sqm-go-collector.plan}"
+sqm_go_aggregate="${sqm_go_aggregate:-}"
+sqm_go_source="${sqm_go_source:-}"
+sqm_go_templates="${sqm_go_templates:-}"
+sqm_go_traffic_units="${sqm_go_traffic_units:-}"
+sqm_go_latency_units="${sqm_go_latency_units:-}"
+sqm_go_layout="${sqm_go_layout:-}"
 
 # associative arrays
 declare -A sqm_tns
@@ -77,7 +85,7 @@ sqm_query_tc_array() {
 sqm_query_go_report() {
 	local ifc="$1"
 
-	"$sqm_go_collector_bin" -ifc "$ifc" -mode "$sqm_cake_mq_mode" -format json
+	"$sqm_go_collector_bin" -ifc "$ifc" -mode "$sqm_cake_mq_mode" -format json ${sqm_go_source:+-source "$sqm_go_source"}
 }
 
 sqm_go_interfaces_csv() {
@@ -352,7 +360,17 @@ sqm_update_go() {
 		-ifc "$(sqm_go_interfaces_csv)" \
 		-mode "$sqm_cake_mq_mode" \
 		-format netdata-update \
-		-microseconds "$us"
+		-microseconds "$us" \
+		-priority "${sqm_priority:-90000}" \
+		-update-every "${sqm_update_every:-1}" \
+		${sqm_go_state_file:+-state-file "$sqm_go_state_file"} \
+		${sqm_go_plan_file:+-plan-file "$sqm_go_plan_file"} \
+		${sqm_go_aggregate:+-aggregate "$sqm_go_aggregate"} \
+		${sqm_go_source:+-source "$sqm_go_source"} \
+		${sqm_go_templates:+-templates "$sqm_go_templates"} \
+		${sqm_go_traffic_units:+-traffic-units "$sqm_go_traffic_units"} \
+		${sqm_go_latency_units:+-latency-units "$sqm_go_latency_units"} \
+		${sqm_go_layout:+-layout "$sqm_go_layout"}
 }
 
 sqm_set_overall() {
@@ -1080,7 +1098,7 @@ sqm_check() {
 			echo "Go collector selected, but '$sqm_go_collector_bin' was not found or not executable." 1>&2
 			return 1
 		fi
-		"$sqm_go_collector_bin" -ifc "$(sqm_go_interfaces_csv)" -mode "$sqm_cake_mq_mode" -format netdata-update -microseconds 0 >/dev/null || return 1
+		"$sqm_go_collector_bin" -ifc "$(sqm_go_interfaces_csv)" -mode "$sqm_cake_mq_mode" -format netdata-update -microseconds 0 ${sqm_go_source:+-source "$sqm_go_source"} >/dev/null || return 1
 		return 0
 	fi
 
@@ -1102,7 +1120,13 @@ sqm_create() {
 			-mode "$sqm_cake_mq_mode" \
 			-format netdata-create \
 			-priority "${sqm_priority:-90000}" \
-			-update-every "${sqm_update_every:-1}" || return 1
+			-update-every "${sqm_update_every:-1}" \
+			${sqm_go_plan_file:+-plan-file "$sqm_go_plan_file"} \
+			${sqm_go_source:+-source "$sqm_go_source"} \
+			${sqm_go_templates:+-templates "$sqm_go_templates"} \
+			${sqm_go_traffic_units:+-traffic-units "$sqm_go_traffic_units"} \
+			${sqm_go_latency_units:+-latency-units "$sqm_go_latency_units"} \
+			${sqm_go_layout:+-layout "$sqm_go_layout"} || return 1
 		return 0
 	fi
 
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/emit"
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/plan"
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/sqm"
+)
+
+// runDaemon collects and emits every updateEvery seconds, keeping the previous
+// sample in memory. With -format netdata-update the chart definitions are sent
+// before the first update frame, so the binary can run as a Netdata plugins.d
+// plugin on its own, and charts and dimensions that appear or disappear later
+// (e.g. cake_mq queues or a diffserv change) are defined or obsoleted before
+// the frame that needs them. A positive sampleRate (Hz) additionally snapshots
+// the tin delays between emissions and reports their window statistics. As a
+// plugin, the daemon also answers the Netdata functions of functions.go on
+// stdin and reports consecutive failed collections in a host variable for the
+// sqm_collector_failed alert.
+func runDaemon(c sqm.Collector, state sqm.State, opts outputOptions, sampleRate float64) error {
+	if opts.UpdateEvery <= 0 {
+		opts.UpdateEvery = 1
+	}
+	ticker := time.NewTicker(time.Duration(opts.UpdateEvery) * time.Second)
+	defer ticker.Stop()
+
+	var sampler *sqm.LatencySampler
+	var sampleC <-chan time.Time
+	if sampleRate > 0 {
+		sampler = sqm.NewLatencySampler()
+		sampleTicker := time.NewTicker(time.Duration(float64(time.Second) / sampleRate))
+		defer sampleTicker.Stop()
+		sampleC = sampleTicker.C
+	}
+
+	var functions *functionHandler
+	var requestC chan functionRequest
+	if opts.format == "netdata-update" {
+		functions = &functionHandler{source: c.Source, interfaces: c.Interfaces, updateEvery: opts.UpdateEvery}
+		requestC = make(chan functionRequest)
+		go readFunctions(os.Stdin, requestC)
+	}
+
+	start := time.Now()
+	var charts plan.Plan
+	registered := false
+	failures := 0
+	flush := func() error {
+		now := time.Now()
+		out, err := c.Collect()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			failures++
+			if opts.format == "netdata-update" {
+				return emit.NetdataCollectorStatus(os.Stdout, failures)
+			}
+			return nil
+		}
+		failures = 0
+		if sampler != nil {
+			sampler.Add(out)
+			sampler.Attach(&out)
+		}
+		last := state.Time
+		state.Observe(&out, now)
+		opts.Time, opts.Monotonic = now, now.Sub(start)
+		if opts.format == "netdata-update" {
+			next := opts.Plan.Build(out)
+			if err := emit.NetdataChanges(os.Stdout, charts, next, opts.Priority, opts.UpdateEvery); err != nil {
+				return err
+			}
+			charts = next
+			if !registered {
+				if err := writeFunctionRegistrations(os.Stdout); err != nil {
+					return err
+				}
+				registered = true
+			}
+			functions.last = out
+			opts.Microseconds = 0
+			if !last.IsZero() {
+				opts.Microseconds = now.Sub(last).Microseconds()
+			}
+			if err := writeOutput(os.Stdout, out, opts); err != nil {
+				return err
+			}
+			return emit.NetdataCollectorStatus(os.Stdout, 0)
+		}
+		return writeOutput(os.Stdout, out, opts)
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-sampleC:
+			if out, err := c.Collect(); err == nil {
+				sampler.Add(out)
+			}
+		case req := <-requestC:
+			if err := functions.handle(os.Stdout, req); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
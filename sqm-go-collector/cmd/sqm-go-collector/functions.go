@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/sqm"
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/tcstats"
+)
+
+// Netdata plugins.d functions: the plugin registers "FUNCTION GLOBAL" lines on
+// stdout, Netdata sends "FUNCTION <transaction> <timeout> "<name> <args>""
+// requests on stdin, and every reply is framed by FUNCTION_RESULT_BEGIN and
+// FUNCTION_RESULT_END. See
+// https://learn.netdata.cloud/docs/developer-and-contributor-corner/external-plugins
+// for details.
+
+// functionTimeout is the timeout in seconds Netdata gives our functions.
+const functionTimeout = 10
+
+var functionHelp = []struct{ name, help string }{
+	{"sqm-qdiscs", "CAKE interfaces, queues and tins with rates, delays, drops, flows and options"},
+	{"sqm-raw", "Raw tc qdiscs, classes and filters of an interface (argument: the interface)"},
+}
+
+// functionRequest is one FUNCTION call read from Netdata.
+type functionRequest struct {
+	Transaction string
+	Name        string
+	Args        []string
+}
+
+// writeFunctionRegistrations registers the daemon's functions with Netdata.
+func writeFunctionRegistrations(w io.Writer) error {
+	for _, f := range functionHelp {
+		if _, err := fmt.Fprintf(w, "FUNCTION GLOBAL \"%s\" %d \"%s\"\n", f.name, functionTimeout, f.help); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFunctions sends the FUNCTION requests read from r to requests until r
+// ends. Other commands, such as FUNCTION_CANCEL, are ignored.
+func readFunctions(r io.Reader, requests chan<- functionRequest) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if req, ok := parseFunctionLine(sc.Text()); ok {
+			requests <- req
+		}
+	}
+}
+
+// parseFunctionLine parses a FUNCTION request line. The quoted third word holds
+// the function name followed by its space-separated arguments.
+func parseFunctionLine(line string) (functionRequest, bool) {
+	words := splitQuoted(line)
+	if len(words) < 4 || words[0] != "FUNCTION" {
+		return functionRequest{}, false
+	}
+	call := strings.Fields(words[3])
+	if len(call) == 0 {
+		return functionRequest{}, false
+	}
+	return functionRequest{Transaction: words[1], Name: call[0], Args: call[1:]}, true
+}
+
+// splitQuoted splits line on spaces, keeping single- or double-quoted words
+// together without their quotes.
+func splitQuoted(line string) []string {
+	var words []string
+	var b strings.Builder
+	var quote rune
+	inWord := false
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			b.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, b.String())
+				b.Reset()
+				inWord = false
+			}
+		default:
+			b.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, b.String())
+	}
+	return words
+}
+
+// functionHandler answers function calls from the latest sample of the daemon.
+type functionHandler struct {
+	source      tcstats.Source
+	interfaces  []string
+	updateEvery int
+	last        sqm.Result
+}
+
+// handle writes the reply to req.
+func (h *functionHandler) handle(w io.Writer, req functionRequest) error {
+	status, body := 200, any(nil)
+	switch req.Name {
+	case "sqm-qdiscs":
+		body = qdiscTable(h.last, h.updateEvery)
+	case "sqm-raw":
+		status, body = h.raw(req.Args)
+	default:
+		status, body = 404, functionError(404, fmt.Sprintf("unknown function %q", req.Name))
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(time.Duration(h.updateEvery) * time.Second).Unix()
+	_, err = fmt.Fprintf(w, "FUNCTION_RESULT_BEGIN %s %d application/json %d\n%s\nFUNCTION_RESULT_END\n", req.Transaction, status, expires, b)
+	return err
+}
+
+// rawInterface is the tc output of one interface, as printed by tc.
+type rawInterface struct {
+	Interface string            `json:"interface"`
+	Qdiscs    json.RawMessage   `json:"qdiscs,omitempty"`
+	Classes   json.RawMessage   `json:"classes,omitempty"`
+	Filters   json.RawMessage   `json:"filters,omitempty"`
+	Errors    map[string]string `json:"errors,omitempty"`
+}
+
+// raw returns the unmodified tc output of the interfaces named in args, given
+// as "eth0" or "interface:eth0", or of all collected interfaces. Only collected
+// interfaces are accepted, since the names end up on a (possibly remote) tc
+// command line. Failing parts are reported per interface; the call fails when
+// no interface has qdiscs.
+func (h *functionHandler) raw(args []string) (int, any) {
+	var interfaces []string
+	for _, a := range args {
+		if k, v, ok := strings.Cut(a, ":"); ok && (k == "interface" || k == "ifc") {
+			a = v
+		}
+		interfaces = append(interfaces, splitNonEmpty(a, ",")...)
+	}
+	for _, ifc := range interfaces {
+		if !slices.Contains(h.interfaces, ifc) {
+			return 400, functionError(400, fmt.Sprintf("interface %q is not collected (expected one of %s)", ifc, strings.Join(h.interfaces, "|")))
+		}
+	}
+	if len(interfaces) == 0 {
+		interfaces = h.interfaces
+	}
+	src, ok := h.source.(tcstats.RawSource)
+	if h.source == nil {
+		src, ok = tcstats.Exec{}, true
+	}
+	if !ok {
+		return 501, functionError(501, "the qdisc source has no raw tc output")
+	}
+	out := make([]rawInterface, 0, len(interfaces))
+	var failed []string
+	for _, ifc := range interfaces {
+		r := rawInterface{Interface: ifc}
+		for _, part := range []struct {
+			object string
+			dst    *json.RawMessage
+		}{{"qdisc", &r.Qdiscs}, {"class", &r.Classes}, {"filter", &r.Filters}} {
+			raw, err := src.Raw(part.object, ifc)
+			if err != nil {
+				if r.Errors == nil {
+					r.Errors = make(map[string]string)
+				}
+				r.Errors[part.object] = err.Error()
+				if part.object == "qdisc" {
+					failed = append(failed, fmt.Sprintf("%s: %v", ifc, err))
+				}
+				continue
+			}
+			*part.dst = raw
+		}
+		out = append(out, r)
+	}
+	if len(failed) == len(interfaces) {
+		return 404, functionError(404, strings.Join(failed, "; "))
+	}
+	return 200, map[string]any{"status": 200, "interfaces": out}
+}
+
+func functionError(status int, msg string) map[string]any {
+	return map[string]any{"status": status, "error_message": msg}
+}
+
+// tableColumn is a column of a Netdata function table.
+type tableColumn struct {
+	Index     int    `json:"index"`
+	UniqueKey bool   `json:"unique_key"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Visible   bool   `json:"visible"`
+	Units     string `json:"units,omitempty"`
+}
+
+// qdiscColumns lists the sqm-qdiscs columns in row order: key, name, type and
+// units. The first column is the hidden unique key of a row.
+var qdiscColumns = []struct{ key, name, typ, units string }{
+	{"id", "ID", "string", ""},
+	{"interface", "Interface", "string", ""},
+	{"queue", "Queue", "string", ""},
+	{"tin", "Tin", "string", ""},
+	{"root_kind", "Root", "string", ""},
+	{"bandwidth", "Bandwidth", "number", "Mb/s"},
+	{"rate", "Rate", "number", "Mb/s"},
+	{"threshold", "Threshold", "number", "Mb/s"},
+	{"utilisation", "Utilisation", "number", "%"},
+	{"target", "Target", "number", "ms"},
+	{"peak_delay", "Peak Delay", "number", "ms"},
+	{"avg_delay", "Avg Delay", "number", "ms"},
+	{"base_delay", "Base Delay", "number", "ms"},
+	{"backlog", "Backlog", "integer", "bytes"},
+	{"drops", "Drops", "integer", "packets"},
+	{"ecn_marks", "ECN Marks", "integer", "packets"},
+	{"ack_drops", "ACK Drops", "integer", "packets"},
+	{"sparse_flows", "Sparse Flows", "integer", "flows"},
+	{"bulk_flows", "Bulk Flows", "integer", "flows"},
+	{"unresponsive_flows", "Unresponsive Flows", "integer", "flows"},
+	{"diffserv", "Diffserv", "string", ""},
+	{"options", "Options", "string", ""},
+}
+
+// qdiscTable returns the sqm-qdiscs table: one row per tin of every queue of
+// out. Rates need two samples, so they are zero right after the daemon starts.
+func qdiscTable(out sqm.Result, updateEvery int) map[string]any {
+	columns := make(map[string]tableColumn, len(qdiscColumns))
+	for i, c := range qdiscColumns {
+		columns[c.key] = tableColumn{Index: i, UniqueKey: i == 0, Name: c.name, Type: c.typ, Visible: i != 0, Units: c.units}
+	}
+	rows := make([][]any, 0)
+	for _, r := range out.Reports {
+		for _, q := range r.Queues {
+			bandwidth := q.Bandwidth
+			if bandwidth == 0 {
+				bandwidth = r.Bandwidth
+			}
+			var diffserv, options string
+			if q.Options != nil {
+				diffserv, options = q.Options.Diffserv, q.Options.Summary()
+			}
+			for _, t := range q.Tins {
+				var rate, util float64
+				if t.Rates != nil {
+					rate, util = t.Rates.SentBytes, t.Rates.Utilisation
+				}
+				rows = append(rows, []any{
+					r.Interface + "/" + q.QueueID + "/" + t.Tin,
+					r.Interface, q.QueueID, t.Tin, r.RootKind,
+					megabits(float64(bandwidth)), megabits(rate), megabits(float64(t.ThresholdRate)), util,
+					millis(t.TargetUS), millis(t.PeakDelayUS), millis(t.AvgDelayUS), millis(t.BaseDelayUS),
+					t.BacklogBytes, t.Drops, t.ECNMark, t.AckDrops,
+					t.SparseFlows, t.BulkFlows, t.UnresponsiveFlows,
+					diffserv, options,
+				})
+			}
+		}
+	}
+	return map[string]any{
+		"status":              200,
+		"type":                "table",
+		"has_history":         false,
+		"help":                functionHelp[0].help,
+		"update_every":        updateEvery,
+		"default_sort_column": "interface",
+		"data":                rows,
+		"columns":             columns,
+	}
+}
+
+// megabits converts bytes per second to megabits per second.
+func megabits(bytesPerSecond float64) float64 {
+	return bytesPerSecond * 8 / 1e6
+}
+
+func millis(us uint64) float64 {
+	return float64(us) / 1000
+}
@@ -2,126 +2,254 @@ package main
 
 import (
 	"bytes"
-	"io"
+	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/sqm"
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/tcstats"
 )
 
-func captureStdout(t *testing.T, fn func()) string {
-	t.Helper()
+func TestRunRPCDListAndUnknownMethod(t *testing.T) {
+	var out bytes.Buffer
+	if err := runRPCD([]string{"list"}, strings.NewReader(""), &out); err != nil {
+		t.Fatalf("rpcd list: %v", err)
+	}
+	if !strings.Contains(out.String(), `"report":{"ifc":"str","mode":"str"}`) {
+		t.Fatalf("missing report signature in list output: %s", out.String())
+	}
 
-	old := os.Stdout
-	r, w, err := os.Pipe()
-	if err != nil {
-		t.Fatalf("pipe: %v", err)
+	out.Reset()
+	if err := runRPCD([]string{"call", "bogus"}, strings.NewReader("{}"), &out); err != nil {
+		t.Fatalf("rpcd call: %v", err)
+	}
+	if !strings.Contains(out.String(), `"error":"unknown method \"bogus\""`) {
+		t.Fatalf("expected error reply for unknown method: %s", out.String())
+	}
+}
+
+func TestRunRPCDStatusFromReplay(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "eth0.qdisc.json"), []byte(`[{"kind":"fq_codel","handle":"0:","root":true}]`), 0o644); err != nil {
+		t.Fatal(err)
 	}
-	os.Stdout = w
-	defer func() { os.Stdout = old }()
+	old := rpcdSource
+	rpcdSource = tcstats.NewReplay(dir)
+	defer func() { rpcdSource = old }()
 
-	fn()
-	_ = w.Close()
+	var out bytes.Buffer
+	if err := runRPCD([]string{"call", "status"}, strings.NewReader(`{"ifc":"eth0"}`), &out); err != nil {
+		t.Fatalf("rpcd call: %v", err)
+	}
+	if !strings.Contains(out.String(), `"root_kind":"fq_codel"`) || !strings.Contains(out.String(), `"ok":false`) {
+		t.Fatalf("unexpected status reply: %s", out.String())
+	}
+}
 
-	var buf bytes.Buffer
-	_, _ = io.Copy(&buf, r)
-	_ = r.Close()
-	return buf.String()
+func TestParseFunctionLine(t *testing.T) {
+	req, ok := parseFunctionLine(`FUNCTION tx-1 10 "sqm-raw interface:eth0" 0x1 "method=api"`)
+	if !ok || req.Transaction != "tx-1" || req.Name != "sqm-raw" || len(req.Args) != 1 || req.Args[0] != "interface:eth0" {
+		t.Fatalf("unexpected request: %+v %v", req, ok)
+	}
+	if _, ok := parseFunctionLine("FUNCTION_CANCEL tx-1"); ok {
+		t.Fatal("FUNCTION_CANCEL parsed as a request")
+	}
 }
 
-func TestBuildPlanOverlayDimensions(t *testing.T) {
-	in := result{
-		Reports: []ifaceReport{
-			{
-				Interface: "eth0",
-				Mode:      "overlay",
-				Overview:  overview{Bytes: 1000, Drops: 1, Backlog: 0},
-				Queues: []queueReport{
-					{
-						QueueID: "1",
-						Tins: []tinMetrics{
-							{
-								Tin:           "BE",
-								ThresholdRate: 125000000,
-								SentBytes:     200000,
-							},
-						},
-					},
-				},
-			},
-		},
-	}
-
-	plan := buildPlan(in)
-	var foundChart *chartDef
-	for i := range plan.Charts {
-		if plan.Charts[i].ID == "SQM.eth0_BE_traffic" {
-			foundChart = &plan.Charts[i]
-			break
+func TestFunctionHandler(t *testing.T) {
+	dir := t.TempDir()
+	qdiscs := `[{"kind":"cake","handle":"1:","root":true,"options":{"bandwidth":12500000,"diffserv":"besteffort","flowmode":"triple-isolate","nat":true,"rtt":100000},
+		"tins":[{"threshold_rate":12500000,"target_us":5000,"peak_delay_us":1500,"drops":3}],"future_field":1}]`
+	if err := os.WriteFile(filepath.Join(dir, "eth0.qdisc.json"), []byte(qdiscs), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	src := tcstats.NewReplay(dir)
+	out, err := sqm.Collector{Source: src, Interfaces: []string{"eth0"}, Mode: sqm.ModeCakeMQ}.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &functionHandler{source: src, interfaces: []string{"eth0", "eth9"}, updateEvery: 1, last: out}
+
+	var b bytes.Buffer
+	if err := h.handle(&b, functionRequest{Transaction: "tx-1", Name: "sqm-qdiscs"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"FUNCTION_RESULT_BEGIN tx-1 200 application/json ",
+		`"type":"table"`,
+		`["eth0/root/T0","eth0","root","T0","cake",100,0,100,0,5,1.5,0,0,0,3,`,
+		`"besteffort","triple-isolate nat rtt 100ms"]`,
+		"FUNCTION_RESULT_END\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Fatalf("sqm-qdiscs reply missing %q:\n%s", want, b.String())
 		}
 	}
-	if foundChart == nil {
-		t.Fatalf("missing chart SQM.eth0_BE_traffic")
+
+	b.Reset()
+	if err := h.handle(&b, functionRequest{Transaction: "tx-2", Name: "sqm-raw", Args: []string{"interface:eth0"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "FUNCTION_RESULT_BEGIN tx-2 200 ") || !strings.Contains(b.String(), `"future_field":1`) {
+		t.Fatalf("sqm-raw reply is not the unmodified tc output:\n%s", b.String())
+	}
+
+	b.Reset()
+	if err := h.handle(&b, functionRequest{Transaction: "tx-3", Name: "sqm-raw", Args: []string{"eth9"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "FUNCTION_RESULT_BEGIN tx-3 404 ") {
+		t.Fatalf("expected 404 for a missing interface:\n%s", b.String())
+	}
+
+	b.Reset()
+	if err := h.handle(&b, functionRequest{Transaction: "tx-4", Name: "sqm-raw", Args: []string{"eth0;reboot"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "FUNCTION_RESULT_BEGIN tx-4 400 ") {
+		t.Fatalf("expected 400 for an interface that is not collected:\n%s", b.String())
+	}
+}
+
+func TestRunWatch(t *testing.T) {
+	dir := t.TempDir()
+	qdiscs := `[{"kind":"cake","handle":"1:","root":true,"options":{"bandwidth":12500000,"diffserv":"besteffort"},"tins":[{"threshold_rate":12500000,"target_us":5000}]}]`
+	if err := os.WriteFile(filepath.Join(dir, "eth0.qdisc.json"), []byte(qdiscs), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := runWatch([]string{"-ifc", "eth0", "-source", "replay:" + dir, "-interval", "100ms", "-count", "2"}, &out); err != nil {
+		t.Fatalf("runWatch: %v", err)
+	}
+	frames := strings.Split(out.String(), clearScreen)
+	if len(frames) != 3 || !strings.HasPrefix(frames[1], "Every 100ms: sqm-go-collector watch -ifc eth0 -mode cake_mq") {
+		t.Fatalf("expected two cleared frames, got %q", out.String())
+	}
+	if !strings.Contains(frames[1], "root   T0   -") || !strings.Contains(frames[2], "0 bit/s") {
+		t.Fatalf("expected rates from the second frame on:\n%s", out.String())
+	}
+
+	if err := runWatch([]string{"-ifc", "eth0", "-interval", "1ms"}, &out); err == nil {
+		t.Fatal("expected an error for a too short -interval")
+	}
+}
+
+func TestOneShotCollectorStatus(t *testing.T) {
+	dir := t.TempDir()
+	qdiscs := `[{"kind":"cake","handle":"1:","root":true,"options":{"bandwidth":12500000,"diffserv":"besteffort"},"tins":[{"threshold_rate":12500000,"target_us":5000}]}]`
+	if err := os.WriteFile(filepath.Join(dir, "eth0.qdisc.json"), []byte(qdiscs), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ok := sqm.Collector{Source: tcstats.NewReplay(dir), Interfaces: []string{"eth0"}, Mode: sqm.ModeCakeMQ}
+	failing := sqm.Collector{Source: tcstats.NewReplay(dir), Interfaces: []string{"eth9"}, Mode: sqm.ModeCakeMQ}
+	update := outputOptions{format: "netdata-update"}
+	o := oneShot{stateFile: filepath.Join(t.TempDir(), "state.json")}
+
+	var out bytes.Buffer
+	if err := o.run(&out, ok, update); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `BEGIN "SQM.eth0_overview"`) || !strings.HasSuffix(out.String(), "VARIABLE HOST sqm_collector_failures = 0\n") {
+		t.Fatalf("expected an update frame followed by the collector status:\n%s", out.String())
 	}
 
-	var q1Bytes, q1Thres *dimensionDef
-	for i := range foundChart.Dims {
-		switch foundChart.Dims[i].ID {
-		case "q1_bytes":
-			q1Bytes = &foundChart.Dims[i]
-		case "q1_thres":
-			q1Thres = &foundChart.Dims[i]
+	for want := 1; want <= 2; want++ {
+		out.Reset()
+		if err := o.run(&out, failing, update); err == nil {
+			t.Fatal("expected a collection error")
 		}
+		if got := out.String(); got != fmt.Sprintf("VARIABLE HOST sqm_collector_failures = %d\n", want) {
+			t.Fatalf("failed run %d wrote %q", want, got)
+		}
+	}
+
+	out.Reset()
+	if err := o.run(&out, ok, update); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(out.String(), "VARIABLE HOST sqm_collector_failures = 0\n") {
+		t.Fatalf("expected the failures to be reset:\n%s", out.String())
 	}
-	if q1Bytes == nil || q1Thres == nil {
-		t.Fatalf("missing expected overlay dimensions in traffic chart")
+	if state, err := sqm.LoadState(o.stateFile); err != nil || state.Failures != 0 {
+		t.Fatalf("state failures = %d, %v; want 0", state.Failures, err)
 	}
-	if q1Bytes.Algo != "incremental" || q1Bytes.Mul != 1 || q1Bytes.Div != 125 {
-		t.Fatalf("unexpected q1_bytes dim config: %+v", *q1Bytes)
+
+	out.Reset()
+	if err := (oneShot{}).run(&out, failing, update); err == nil || out.String() != "VARIABLE HOST sqm_collector_failures = 1\n" {
+		t.Fatalf("without a state file a failed run must report 1 failure, got %q (%v)", out.String(), err)
 	}
-	if q1Thres.Algo != "absolute" || q1Thres.Mul != 1 || q1Thres.Div != 125 {
-		t.Fatalf("unexpected q1_thres dim config: %+v", *q1Thres)
+	out.Reset()
+	if err := (oneShot{}).run(&out, ok, outputOptions{format: "json"}); err != nil || strings.Contains(out.String(), "VARIABLE") {
+		t.Fatalf("only netdata-update reports the collector status, got %q (%v)", out.String(), err)
 	}
 }
 
-func TestEmitNetdataCreateAndUpdate(t *testing.T) {
-	plan := planOutput{
-		Charts: []chartDef{
-			{
-				ID:      "SQM.eth0_overview",
-				Title:   "SQM qdisc eth0 Overview",
-				Units:   "mixed",
-				Family:  "eth0 Qdisc",
-				Context: "overview",
-				Dims: []dimensionDef{
-					{ID: "bytes", Name: "Bytes", Algo: "incremental", Mul: 1, Div: 1},
-				},
-			},
-		},
-		Updates: map[string]map[string]uint64{
-			"SQM.eth0_overview": {"bytes": 1234},
-		},
-	}
-
-	createOut := captureStdout(t, func() {
-		emitNetdataCreate(plan, 90000, 1)
-	})
-	if !strings.Contains(createOut, `CHART "SQM.eth0_overview"`) {
-		t.Fatalf("missing CHART line in create output: %s", createOut)
-	}
-	if !strings.Contains(createOut, `DIMENSION 'bytes' 'Bytes' incremental 1 1`) {
-		t.Fatalf("missing DIMENSION line in create output: %s", createOut)
-	}
-
-	updateOut := captureStdout(t, func() {
-		emitNetdataUpdate(plan, 1000000)
-	})
-	if !strings.Contains(updateOut, `BEGIN "SQM.eth0_overview" 1000000`) {
-		t.Fatalf("missing BEGIN line in update output: %s", updateOut)
-	}
-	if !strings.Contains(updateOut, `SET 'bytes' = 1234`) {
-		t.Fatalf("missing SET line in update output: %s", updateOut)
-	}
-	if !strings.Contains(updateOut, "END") {
-		t.Fatalf("missing END line in update output: %s", updateOut)
+func TestTopModel(t *testing.T) {
+	if got := parseKeys([]byte("j\033[A\033[Bq\n\033[5~f")); strings.Join(got, ",") != "j,up,down,q,f" {
+		t.Fatalf("parseKeys = %v", got)
+	}
+	if got := sparkline([]float64{0, 5, 10}, 5); got != "  ▁▅█" {
+		t.Fatalf("sparkline = %q", got)
+	}
+
+	dir := t.TempDir()
+	qdiscs := `[{"kind":"cake_mq","handle":"1:","root":true},
+		{"kind":"cake","handle":"10:","parent":"1:1","options":{"diffserv":"besteffort"},"tins":[{"sent_bytes":100,"peak_delay_us":1500}]},
+		{"kind":"cake","handle":"20:","parent":"1:2","options":{"diffserv":"besteffort"},"tins":[{"sent_bytes":200,"peak_delay_us":500}]}]`
+	for _, ifc := range []string{"eth0", "eth1"} {
+		if err := os.WriteFile(filepath.Join(dir, ifc+".qdisc.json"), []byte(qdiscs), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := newTopModel(sqm.Collector{Source: tcstats.NewReplay(dir), Interfaces: []string{"eth0", "eth1"}, Mode: sqm.ModeCakeMQ}, time.Second, 4)
+	sample := func(at time.Time) {
+		s := collectTopSample(m.collector)
+		s.at = at
+		m.record(s)
+	}
+	now := time.Now()
+	sample(now)
+	sample(now.Add(time.Second))
+
+	var b bytes.Buffer
+	m.render(&b)
+	if !strings.Contains(b.String(), "> eth0  cake_mq 1:  mode cake_mq") || !strings.Contains(b.String(), "TIN  RATE") || !strings.Contains(b.String(), "T0   0 bit/s") {
+		t.Fatalf("unexpected cake_mq frame:\n%s", b.String())
+	}
+
+	stale := collectTopSample(m.collector)
+	if m.key("down") || m.key("f") || m.key("2") {
+		t.Fatal("unexpected quit")
+	}
+	if m.frozen || m.collector.Mode != sqm.ModeQueue || !m.pending {
+		t.Fatalf("expected an unfrozen queue mode waiting for a sample: %+v", m)
+	}
+	m.record(stale)
+	if len(m.last.Reports) != 0 {
+		t.Fatal("a sample of the previous mode must be dropped")
+	}
+	sample(now)
+	b.Reset()
+	m.render(&b)
+	if !strings.Contains(b.String(), "> eth1  cake_mq 1:  mode queue") || !strings.Contains(b.String(), "QUEUE  TIN") || !strings.Contains(b.String(), "2      T0   -") {
+		t.Fatalf("expected a queue mode frame for eth1:\n%s", b.String())
+	}
+
+	m.key("3")
+	sample(now)
+	b.Reset()
+	m.render(&b)
+	if !strings.Contains(b.String(), "TIN  Q1 RATE/PEAK  Q2 RATE/PEAK") || !strings.Contains(b.String(), "T0   - / 1.5ms     - / 500us") {
+		t.Fatalf("expected an overlay frame with a column per queue:\n%s", b.String())
+	}
+	if m.key("f"); !m.frozen {
+		t.Fatal("expected f to freeze the display")
+	}
+	if !m.key("q") {
+		t.Fatal("expected q to quit")
 	}
 }
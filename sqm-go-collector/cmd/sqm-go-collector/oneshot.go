@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/emit"
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/plan"
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/sqm"
+)
+
+// oneShot holds the files and bufferbloat settings a one-shot run keeps state
+// in between runs.
+type oneShot struct {
+	stateFile   string
+	planFile    string
+	bloatLoad   float64
+	bloatWindow time.Duration
+}
+
+// run collects once and writes the output of opts to w. With -format
+// netdata-update it ends with the sqm_collector_failures host variable, as the
+// daemon does: zero after a successful collection, or the number of
+// consecutive failed runs (counted in stateFile, 1 without one) before the
+// collection error is returned.
+func (o oneShot) run(w io.Writer, c sqm.Collector, opts outputOptions) error {
+	out, err := c.Collect()
+	if err != nil {
+		if opts.format == "netdata-update" {
+			if err := emit.NetdataCollectorStatus(w, o.recordFailure()); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+	opts.Time = time.Now()
+
+	if o.stateFile != "" {
+		state, err := sqm.LoadState(o.stateFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "warning: discarding unreadable state file:", err)
+		}
+		state.BloatLoadPct, state.BloatWindow = o.bloatLoad, o.bloatWindow
+		state.Failures = 0
+		state.Observe(&out, opts.Time)
+		if err := sqm.SaveState(o.stateFile, state); err != nil {
+			return err
+		}
+	}
+
+	if o.planFile != "" && (opts.format == "netdata-create" || opts.format == "netdata-update") {
+		next := opts.Plan.Build(out)
+		if opts.format == "netdata-update" {
+			prev, err := plan.LoadCharts(o.planFile)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "warning: discarding unreadable plan file:", err)
+			}
+			if err := emit.NetdataChanges(w, prev, next, opts.Priority, opts.UpdateEvery); err != nil {
+				return err
+			}
+		}
+		if err := plan.SaveCharts(o.planFile, next); err != nil {
+			return err
+		}
+	}
+
+	if err := writeOutput(w, out, opts); err != nil {
+		return err
+	}
+	if opts.format == "netdata-update" {
+		return emit.NetdataCollectorStatus(w, 0)
+	}
+	return nil
+}
+
+// recordFailure counts a failed collection in stateFile and returns the number
+// of consecutive failures.
+func (o oneShot) recordFailure() int {
+	if o.stateFile == "" {
+		return 1
+	}
+	state, err := sqm.LoadState(o.stateFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "warning: discarding unreadable state file:", err)
+	}
+	state.Failures++
+	if err := sqm.SaveState(o.stateFile, state); err != nil {
+		fmt.Fprintln(os.Stderr, "warning: cannot save state file:", err)
+	}
+	return state.Failures
+}
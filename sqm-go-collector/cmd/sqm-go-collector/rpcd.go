@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/sqm"
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/tcstats"
+)
+
+// rpcd exec plugin protocol: "list" prints the method signatures, "call <method>"
+// reads the JSON arguments from stdin and prints a JSON object as the reply.
+// See https://openwrt.org/docs/techref/rpcd for details.
+
+type rpcdArgs struct {
+	Ifc  string `json:"ifc"`
+	Mode string `json:"mode"`
+}
+
+type rpcdInterface struct {
+	Interface  string `json:"interface"`
+	RootKind   string `json:"root_kind"`
+	RootHandle string `json:"root_handle"`
+}
+
+type rpcdStatus struct {
+	Interface string `json:"interface"`
+	OK        bool   `json:"ok"`
+	RootKind  string `json:"root_kind,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// rpcdSource is the qdisc source of rpcd calls. rpcd passes no flags, so it
+// is always tc; tests replace it.
+var rpcdSource tcstats.Source = tcstats.Exec{}
+
+var rpcdMethods = map[string]map[string]string{
+	"status":     {"ifc": "str"},
+	"report":     {"ifc": "str", "mode": "str"},
+	"interfaces": {},
+}
+
+func netInterfaceNames() ([]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(ifaces))
+	for _, ifc := range ifaces {
+		names = append(names, ifc.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func runRPCD(args []string, in io.Reader, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: rpcd list | rpcd call <method>")
+	}
+
+	switch args[0] {
+	case "list":
+		return writeRPCDReply(out, rpcdMethods)
+	case "call":
+		if len(args) < 2 {
+			return errors.New("usage: rpcd call <method>")
+		}
+		var req rpcdArgs
+		if err := json.NewDecoder(in).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			return writeRPCDReply(out, map[string]string{"error": fmt.Sprintf("invalid arguments: %v", err)})
+		}
+		reply, err := callRPCD(args[1], req)
+		if err != nil {
+			return writeRPCDReply(out, map[string]string{"error": err.Error()})
+		}
+		return writeRPCDReply(out, reply)
+	default:
+		return fmt.Errorf("unknown rpcd command %q (expected list|call)", args[0])
+	}
+}
+
+func callRPCD(method string, req rpcdArgs) (any, error) {
+	switch method {
+	case "interfaces":
+		ifaces, err := rpcdCakeInterfaces()
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]rpcdInterface{"interfaces": ifaces}, nil
+	case "status":
+		interfaces, err := rpcdResolveInterfaces(req.Ifc)
+		if err != nil {
+			return nil, err
+		}
+		status := make([]rpcdStatus, 0, len(interfaces))
+		for _, ifc := range interfaces {
+			st := rpcdStatus{Interface: ifc}
+			qdiscs, err := rpcdSource.Qdiscs(ifc)
+			root, ok := tcstats.Root(qdiscs)
+			switch {
+			case err != nil:
+				st.Error = err.Error()
+			case !ok:
+				st.Error = "no root qdisc found"
+			default:
+				st.RootKind = root.Kind
+				st.OK = root.Kind == "cake" || root.Kind == "cake_mq"
+				if !st.OK {
+					st.Error = fmt.Sprintf("root qdisc kind %q is not cake", root.Kind)
+				}
+			}
+			status = append(status, st)
+		}
+		return map[string][]rpcdStatus{"status": status}, nil
+	case "report":
+		mode := req.Mode
+		if mode == "" {
+			mode = sqm.ModeCakeMQ
+		}
+		if !sqm.ValidMode(mode) {
+			return nil, fmt.Errorf("invalid mode %q (expected cake_mq|queue|overlay)", mode)
+		}
+		interfaces, err := rpcdResolveInterfaces(req.Ifc)
+		if err != nil {
+			return nil, err
+		}
+		return sqm.Collector{Source: rpcdSource, Interfaces: interfaces, Mode: mode, Aggregation: sqm.DefaultAggregation}.Collect()
+	default:
+		return nil, fmt.Errorf("unknown method %q", method)
+	}
+}
+
+func rpcdResolveInterfaces(raw string) ([]string, error) {
+	if interfaces := splitNonEmpty(raw, ","); len(interfaces) > 0 {
+		return interfaces, nil
+	}
+	ifaces, err := rpcdCakeInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	interfaces := make([]string, 0, len(ifaces))
+	for _, ifc := range ifaces {
+		interfaces = append(interfaces, ifc.Interface)
+	}
+	if len(interfaces) == 0 {
+		return nil, errors.New("no interfaces with a cake root qdisc found")
+	}
+	return interfaces, nil
+}
+
+func rpcdCakeInterfaces() ([]rpcdInterface, error) {
+	names, err := netInterfaceNames()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]rpcdInterface, 0)
+	for _, name := range names {
+		qdiscs, err := rpcdSource.Qdiscs(name)
+		if err != nil {
+			continue
+		}
+		root, ok := tcstats.Root(qdiscs)
+		if !ok || (root.Kind != "cake" && root.Kind != "cake_mq") {
+			continue
+		}
+		out = append(out, rpcdInterface{Interface: name, RootKind: root.Kind, RootHandle: root.Handle})
+	}
+	return out, nil
+}
+
+func writeRPCDReply(out io.Writer, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, string(b))
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// makeRaw is not supported on this platform; top then reads keys a line at a
+// time.
+func makeRaw(fd uintptr) (func(), error) {
+	return nil, errors.New("raw terminal mode is not supported on this platform")
+}
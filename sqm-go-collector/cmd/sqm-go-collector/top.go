@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/emit"
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/sqm"
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/tcstats"
+)
+
+// Terminal control sequences used by top.
+const (
+	enterAltScreen = "\033[?1049h\033[?25l"
+	leaveAltScreen = "\033[?25h\033[?1049l"
+)
+
+var (
+	topModes   = []string{sqm.ModeCakeMQ, sqm.ModeQueue, sqm.ModeOverlay}
+	sparkRunes = []rune("▁▂▃▄▅▆▇█")
+)
+
+// runTop implements the top subcommand, an interactive terminal dashboard: a
+// list of the interfaces with their summary line and, for the selected one,
+// its tins in the view of the report mode: one aggregated row per tin with
+// sparklines of its rate and peak delay (cake_mq), a row per queue and tin
+// (queue) or a row per tin with a column per queue (overlay). Keys switch the
+// interface and mode and freeze the display. Samples are collected on a
+// separate goroutine, so a slow tc does not hold up key presses.
+func runTop(args []string, in *os.File, out io.Writer) error {
+	fs := flag.NewFlagSet("top", flag.ContinueOnError)
+	interfacesRaw := fs.String("ifc", "", "Comma-separated interfaces (e.g. eth0,ifb4eth0)")
+	mode := fs.String("mode", "cake_mq", "Initial mode: cake_mq|queue|overlay")
+	source := fs.String("source", "tc", "Qdisc source: tc|netlink|replay:<dir>|remote:<cmd>")
+	aggregateRaw := fs.String("aggregate", "", "cake_mq latency aggregation as metric=policy pairs")
+	interval := fs.Duration("interval", time.Second, "Time between samples")
+	history := fs.Int("history", 30, "Samples shown in each sparkline")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	interfaces := splitNonEmpty(*interfacesRaw, ",")
+	if len(interfaces) == 0 {
+		return errors.New("-ifc is required")
+	}
+	if !sqm.ValidMode(*mode) {
+		return fmt.Errorf("invalid -mode %q (expected cake_mq|queue|overlay)", *mode)
+	}
+	if *interval < 100*time.Millisecond {
+		return fmt.Errorf("invalid -interval %s (expected at least 100ms)", *interval)
+	}
+	if *history < 1 {
+		return fmt.Errorf("invalid -history %d (expected a positive number)", *history)
+	}
+	src, err := tcstats.ParseSource(*source)
+	if err != nil {
+		return fmt.Errorf("invalid -source: %w", err)
+	}
+	agg, err := sqm.ParseAggregation(*aggregateRaw)
+	if err != nil {
+		return fmt.Errorf("invalid -aggregate: %w", err)
+	}
+
+	m := newTopModel(sqm.Collector{Source: src, Interfaces: interfaces, Mode: *mode, Aggregation: agg}, *interval, *history)
+
+	if restore, err := makeRaw(in.Fd()); err == nil {
+		defer restore()
+	}
+	io.WriteString(out, enterAltScreen)
+	defer io.WriteString(out, leaveAltScreen)
+
+	keys := make(chan string)
+	go readKeys(in, keys)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	requests := make(chan sqm.Collector, 1)
+	samples := make(chan topSample, 1)
+	go collectTop(requests, samples)
+	defer close(requests)
+	// request queues a collection with the current mode, replacing one that
+	// has not started yet.
+	request := func() {
+		select {
+		case <-requests:
+		default:
+		}
+		requests <- m.collector
+	}
+
+	request()
+	for {
+		var frame bytes.Buffer
+		frame.WriteString(clearScreen)
+		m.render(&frame)
+		if _, err := out.Write(frame.Bytes()); err != nil {
+			return err
+		}
+		select {
+		case <-sigs:
+			return nil
+		case k, ok := <-keys:
+			if !ok {
+				keys = nil
+				continue
+			}
+			if m.key(k) {
+				return nil
+			}
+			if m.pending {
+				m.pending = false
+				request()
+			}
+		case <-ticker.C:
+			if !m.frozen {
+				request()
+			}
+		case s := <-samples:
+			m.record(s)
+		}
+	}
+}
+
+// topSample is one collection of the top dashboard in mode.
+type topSample struct {
+	mode string
+	at   time.Time
+	out  sqm.Result
+	err  error
+}
+
+// collectTop collects a sample with every collector received on requests and
+// sends it to samples, until requests is closed.
+func collectTop(requests <-chan sqm.Collector, samples chan<- topSample) {
+	for c := range requests {
+		samples <- collectTopSample(c)
+	}
+}
+
+func collectTopSample(c sqm.Collector) topSample {
+	out, err := c.Collect()
+	return topSample{mode: c.Mode, at: time.Now(), out: out, err: err}
+}
+
+// readKeys sends the keys read from r to keys and closes it when r ends.
+func readKeys(r io.Reader, keys chan<- string) {
+	defer close(keys)
+	buf := make([]byte, 16)
+	for {
+		n, err := r.Read(buf)
+		for _, k := range parseKeys(buf[:n]) {
+			keys <- k
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// parseKeys splits terminal input into keys, naming the arrow keys "up" and
+// "down" and dropping line endings and other escape sequences.
+func parseKeys(b []byte) []string {
+	var keys []string
+	for len(b) > 0 {
+		switch {
+		case bytes.HasPrefix(b, []byte("\033[A")):
+			keys = append(keys, "up")
+			b = b[3:]
+		case bytes.HasPrefix(b, []byte("\033[B")):
+			keys = append(keys, "down")
+			b = b[3:]
+		case b[0] == '\033':
+			b = b[1:]
+			for len(b) > 0 && (b[0] == '[' || (b[0] >= '0' && b[0] <= '9') || b[0] == ';') {
+				b = b[1:]
+			}
+			if len(b) > 0 {
+				b = b[1:]
+			}
+		case b[0] == '\r' || b[0] == '\n':
+			b = b[1:]
+		default:
+			keys = append(keys, string(b[0]))
+			b = b[1:]
+		}
+	}
+	return keys
+}
+
+// topModel is the state of the top dashboard.
+type topModel struct {
+	collector sqm.Collector
+	state     sqm.State
+	interval  time.Duration
+	history   int
+
+	selected int
+	frozen   bool
+	pending  bool // a mode change waits for its first sample
+	last     sqm.Result
+	err      error
+	updated  time.Time
+
+	// rates and delays hold the tin rate (bytes/s) and peak delay (us)
+	// history keyed by interface, queue and tin.
+	rates  map[string][]float64
+	delays map[string][]float64
+}
+
+func newTopModel(c sqm.Collector, interval time.Duration, history int) *topModel {
+	m := &topModel{collector: c, interval: interval, history: history}
+	m.reset()
+	return m
+}
+
+// reset drops the previous sample and the history, e.g. after a mode change
+// when queue IDs and rates no longer line up.
+func (m *topModel) reset() {
+	m.state = sqm.NewState(0, 0)
+	m.last = sqm.Result{}
+	m.rates = make(map[string][]float64)
+	m.delays = make(map[string][]float64)
+}
+
+// record adds a sample to the display. Samples collected in another mode than
+// the current one, or while frozen, are dropped.
+func (m *topModel) record(s topSample) {
+	if s.mode != m.collector.Mode || m.frozen {
+		return
+	}
+	m.updated = s.at
+	m.err = s.err
+	if s.err != nil {
+		return
+	}
+	out := s.out
+	m.state.Observe(&out, s.at)
+	m.last = out
+	for _, r := range out.Reports {
+		for _, q := range r.Queues {
+			for _, t := range q.Tins {
+				if t.Rates == nil {
+					continue
+				}
+				k := r.Interface + "/" + q.QueueID + "/" + t.Tin
+				m.rates[k] = m.push(m.rates[k], t.Rates.SentBytes)
+				m.delays[k] = m.push(m.delays[k], float64(t.PeakDelayUS))
+			}
+		}
+	}
+}
+
+func (m *topModel) push(h []float64, v float64) []float64 {
+	h = append(h, v)
+	if len(h) > m.history {
+		h = h[len(h)-m.history:]
+	}
+	return h
+}
+
+// key applies a key press and reports whether top should exit.
+func (m *topModel) key(k string) bool {
+	switch k {
+	case "q", "Q":
+		return true
+	case "up", "k":
+		if m.selected > 0 {
+			m.selected--
+		}
+	case "down", "j":
+		if m.selected < len(m.collector.Interfaces)-1 {
+			m.selected++
+		}
+	case "f", " ":
+		m.frozen = !m.frozen
+	case "m":
+		m.setMode(topModes[(slices.Index(topModes, m.collector.Mode)+1)%len(topModes)])
+	case "1", "2", "3":
+		m.setMode(topModes[k[0]-'1'])
+	}
+	return false
+}
+
+func (m *topModel) setMode(mode string) {
+	if mode == m.collector.Mode {
+		return
+	}
+	m.collector.Mode = mode
+	m.reset()
+	m.frozen = false
+	m.pending = true
+}
+
+// render draws the dashboard to w.
+func (m *topModel) render(w io.Writer) {
+	status := ""
+	if m.frozen {
+		status = "  [FROZEN]"
+	}
+	fmt.Fprintf(w, "sqm-go-collector top  mode %s  every %s  %s%s\n\n", m.collector.Mode, m.interval, m.updated.Format("2006-01-02 15:04:05"), status)
+	if m.err != nil {
+		fmt.Fprintf(w, "error: %v\n\n", m.err)
+	}
+
+	for i, ifc := range m.collector.Interfaces {
+		marker := " "
+		if i == m.selected {
+			marker = ">"
+		}
+		line := ifc + "  (no data)"
+		if r, ok := m.report(ifc); ok {
+			line = emit.InterfaceSummary(r)
+		}
+		fmt.Fprintf(w, "%s %s\n", marker, line)
+	}
+	fmt.Fprintln(w)
+
+	if r, ok := m.report(m.collector.Interfaces[m.selected]); ok {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		switch m.collector.Mode {
+		case sqm.ModeQueue:
+			m.renderQueues(tw, r)
+		case sqm.ModeOverlay:
+			m.renderOverlay(tw, r)
+		default:
+			m.renderTins(tw, r)
+		}
+		tw.Flush()
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintln(w, "up/down j/k: interface  1 cake_mq  2 queue  3 overlay  m: next mode  f/space: freeze  q: quit")
+}
+
+// renderTins draws one row per tin of the aggregated queue of a cake_mq
+// report.
+func (m *topModel) renderTins(w io.Writer, r sqm.InterfaceReport) {
+	fmt.Fprintln(w, "TIN\tRATE\tRATE HISTORY\tPEAK\tPEAK HISTORY\tAVG\tTARGET\tDROPS\tMARKS\tFLOWS")
+	for _, q := range r.Queues {
+		for _, t := range q.Tins {
+			fmt.Fprintf(w, "%s\t%s\n", t.Tin, m.tinColumns(r.Interface, q.QueueID, t))
+		}
+	}
+}
+
+// renderQueues draws one row per queue and tin.
+func (m *topModel) renderQueues(w io.Writer, r sqm.InterfaceReport) {
+	fmt.Fprintln(w, "QUEUE\tTIN\tRATE\tRATE HISTORY\tPEAK\tPEAK HISTORY\tAVG\tTARGET\tDROPS\tMARKS\tFLOWS")
+	for _, q := range r.Queues {
+		for _, t := range q.Tins {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", q.QueueID, t.Tin, m.tinColumns(r.Interface, q.QueueID, t))
+		}
+	}
+}
+
+// renderOverlay draws one row per tin with the rate and peak delay of every
+// queue side by side, as the overlay charts do.
+func (m *topModel) renderOverlay(w io.Writer, r sqm.InterfaceReport) {
+	var tins []string
+	header := "TIN"
+	for _, q := range r.Queues {
+		header += "\tQ" + q.QueueID + " RATE/PEAK"
+		for _, t := range q.Tins {
+			if !slices.Contains(tins, t.Tin) {
+				tins = append(tins, t.Tin)
+			}
+		}
+	}
+	fmt.Fprintln(w, header)
+	for _, tin := range tins {
+		row := tin
+		for _, q := range r.Queues {
+			cell := "-"
+			for _, t := range q.Tins {
+				if t.Tin != tin {
+					continue
+				}
+				rate := "-"
+				if t.Rates != nil {
+					rate = emit.FormatRate(t.Rates.SentBytes)
+				}
+				cell = rate + " / " + emit.FormatDelay(t.PeakDelayUS)
+			}
+			row += "\t" + cell
+		}
+		fmt.Fprintln(w, row)
+	}
+}
+
+// tinColumns returns the tab-separated rate, delay, drop, mark and flow
+// columns of tin t of queue.
+func (m *topModel) tinColumns(ifc, queue string, t sqm.TinMetrics) string {
+	k := ifc + "/" + queue + "/" + t.Tin
+	rate, drops, marks := "-", emit.FormatCount(float64(t.Drops)), emit.FormatCount(float64(t.ECNMark))
+	if tr := t.Rates; tr != nil {
+		rate = emit.FormatRate(tr.SentBytes)
+		drops, marks = emit.FormatCount(tr.Drops)+"/s", emit.FormatCount(tr.ECNMark)+"/s"
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d/%d/%d",
+		rate, sparkline(m.rates[k], m.history),
+		emit.FormatDelay(t.PeakDelayUS), sparkline(m.delays[k], m.history),
+		emit.FormatDelay(t.AvgDelayUS), emit.FormatDelay(t.TargetUS), drops, marks,
+		t.SparseFlows, t.BulkFlows, t.UnresponsiveFlows)
+}
+
+func (m *topModel) report(ifc string) (sqm.InterfaceReport, bool) {
+	for _, r := range m.last.Reports {
+		if r.Interface == ifc {
+			return r, true
+		}
+	}
+	return sqm.InterfaceReport{}, false
+}
+
+// sparkline draws values scaled to their maximum, right-aligned in width
+// columns.
+func sparkline(values []float64, width int) string {
+	var peak float64
+	for _, v := range values {
+		peak = max(peak, v)
+	}
+	var b strings.Builder
+	b.WriteString(strings.Repeat(" ", max(width-len(values), 0)))
+	for _, v := range values {
+		i := 0
+		if peak > 0 {
+			i = min(int(v/peak*float64(len(sparkRunes)-1)+0.5), len(sparkRunes)-1)
+		}
+		b.WriteRune(sparkRunes[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/emit"
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/sqm"
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/tcstats"
+)
+
+// clearScreen moves the cursor home and clears the terminal.
+const clearScreen = "\033[H\033[2J"
+
+// runWatch implements the watch subcommand: it redraws the table format every
+// -interval, with per-second rates from the second frame on, like
+// "watch tc -s qdisc" for CAKE.
+func runWatch(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	interfacesRaw := fs.String("ifc", "", "Comma-separated interfaces (e.g. eth0,ifb4eth0)")
+	mode := fs.String("mode", "cake_mq", "Mode: cake_mq|queue|overlay")
+	source := fs.String("source", "tc", "Qdisc source: tc|netlink|replay:<dir>|remote:<cmd>")
+	aggregateRaw := fs.String("aggregate", "", "cake_mq latency aggregation as metric=policy pairs")
+	interval := fs.Duration("interval", time.Second, "Time between redraws")
+	count := fs.Int("count", 0, "Exit after this many redraws (0 runs until interrupted)")
+	noClear := fs.Bool("no-clear", false, "Append frames instead of clearing the screen")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	interfaces := splitNonEmpty(*interfacesRaw, ",")
+	if len(interfaces) == 0 {
+		return errors.New("-ifc is required")
+	}
+	if !sqm.ValidMode(*mode) {
+		return fmt.Errorf("invalid -mode %q (expected cake_mq|queue|overlay)", *mode)
+	}
+	if *interval < 100*time.Millisecond {
+		return fmt.Errorf("invalid -interval %s (expected at least 100ms)", *interval)
+	}
+	src, err := tcstats.ParseSource(*source)
+	if err != nil {
+		return fmt.Errorf("invalid -source: %w", err)
+	}
+	agg, err := sqm.ParseAggregation(*aggregateRaw)
+	if err != nil {
+		return fmt.Errorf("invalid -aggregate: %w", err)
+	}
+
+	c := sqm.Collector{Source: src, Interfaces: interfaces, Mode: *mode, Aggregation: agg}
+	state := sqm.NewState(0, 0)
+	title := fmt.Sprintf("Every %s: sqm-go-collector watch -ifc %s -mode %s", *interval, strings.Join(interfaces, ","), *mode)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for n := 1; ; n++ {
+		if err := watchFrame(out, c, &state, title, time.Now(), !*noClear); err != nil {
+			return err
+		}
+		if *count > 0 && n >= *count {
+			return nil
+		}
+		<-ticker.C
+	}
+}
+
+// watchFrame collects one sample and draws it below title. Collection errors
+// are shown in the frame so the next redraw can recover.
+func watchFrame(w io.Writer, c sqm.Collector, state *sqm.State, title string, now time.Time, clear bool) error {
+	var b bytes.Buffer
+	if clear {
+		b.WriteString(clearScreen)
+	}
+	fmt.Fprintf(&b, "%s  %s\n\n", title, now.Format("2006-01-02 15:04:05"))
+	res, err := c.Collect()
+	if err != nil {
+		fmt.Fprintln(&b, "error:", err)
+	} else {
+		state.Observe(&res, now)
+		if err := emit.Table(&b, res); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(b.Bytes())
+	return err
+}
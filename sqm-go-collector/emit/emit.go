@@ -0,0 +1,312 @@
+// Package emit writes sqm reports and chart plans in the collector's output
+// formats: JSON, flat metrics and the Netdata plugins.d protocol. Formats are
+// registered by name as Emitters; see Register and Lookup.
+package emit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/plan"
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/sqm"
+)
+
+// JSON writes v as one JSON document, indented when pretty is set.
+func JSON(w io.Writer, v any, pretty bool) error {
+	var b []byte
+	var err error
+	if pretty {
+		b, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		b, err = json.Marshal(v)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+// FlattenMetrics returns the values of in as a flat map keyed by dotted metric
+// names, e.g. "eth0.be.latency.peak". Traffic rates and latencies are in
+// bytes/s and microseconds; a non-zero traffic or latency Unit scales them to
+// that unit instead and renames them to end in the unit name, e.g.
+// "eth0.be.latency.peak_ms". Counters stay in bytes and packets.
+func FlattenMetrics(in sqm.Result, traffic, latency plan.Unit) map[string]float64 {
+	out := make(map[string]float64)
+	// setTraffic and setLatency store v under key, or scaled under key with
+	// the base unit ("bytes_", "_us") replaced by the unit name when a unit is
+	// set.
+	setTraffic := func(key string, bytesPerSecond float64) {
+		if traffic == (plan.Unit{}) {
+			out[key] = bytesPerSecond
+			return
+		}
+		if k, ok := strings.CutSuffix(key, ".bytes_rate"); ok {
+			key = k + ".rate"
+		}
+		out[key+"_"+traffic.Name()] = traffic.Scale(bytesPerSecond)
+	}
+	setLatency := func(key string, us float64) {
+		if latency == (plan.Unit{}) {
+			out[key] = us
+			return
+		}
+		out[strings.TrimSuffix(key, "_us")+"_"+latency.Name()] = latency.Scale(us)
+	}
+
+	for _, rep := range in.Reports {
+		ifc := plan.SanitizeKey(rep.Interface)
+
+		setMetric(out, fmt.Sprintf("%s.overview.bytes", ifc), rep.Overview.Bytes)
+		setMetric(out, fmt.Sprintf("%s.overview.drops", ifc), rep.Overview.Drops)
+		setMetric(out, fmt.Sprintf("%s.overview.packets", ifc), rep.Overview.Packets)
+		setMetric(out, fmt.Sprintf("%s.overview.backlog", ifc), rep.Overview.Backlog)
+		setMetric(out, fmt.Sprintf("%s.overview.overlimits", ifc), rep.Overview.Overlimits)
+		setMetric(out, fmt.Sprintf("%s.overview.requeues", ifc), rep.Overview.Requeues)
+		setMetric(out, fmt.Sprintf("%s.overview.qlen", ifc), rep.Overview.Qlen)
+		if r := rep.Overview.Rates; r != nil {
+			setTraffic(fmt.Sprintf("%s.overview.bytes_rate", ifc), r.Bytes)
+			out[fmt.Sprintf("%s.overview.drops_rate", ifc)] = r.Drops
+			out[fmt.Sprintf("%s.overview.packets_rate", ifc)] = r.Packets
+			out[fmt.Sprintf("%s.overview.overlimits_rate", ifc)] = r.Overlimits
+			out[fmt.Sprintf("%s.overview.requeues_rate", ifc)] = r.Requeues
+			out[fmt.Sprintf("%s.overview.avg_packet_size", ifc)] = r.AvgPacketSize
+			if rep.Bandwidth > 0 {
+				out[fmt.Sprintf("%s.overview.util_pct", ifc)] = r.Utilisation
+			}
+			setRatioMetrics(out, fmt.Sprintf("%s.overview", ifc), r)
+		}
+
+		if bb := rep.Bufferbloat; bb != nil && bb.Samples > 0 {
+			out[fmt.Sprintf("%s.bufferbloat.score", ifc)] = float64(bb.Score)
+			setLatency(fmt.Sprintf("%s.bufferbloat.latency_us", ifc), bb.LatencyUS)
+			setLatency(fmt.Sprintf("%s.bufferbloat.peak_latency_us", ifc), bb.PeakLatencyUS)
+		}
+
+		if ra := rep.RateAdjustments; ra != nil {
+			setMetric(out, fmt.Sprintf("%s.rate_adjustments.changes", ifc), ra.Changes)
+			setTraffic(fmt.Sprintf("%s.rate_adjustments.bandwidth", ifc), float64(ra.Bandwidth))
+			setTraffic(fmt.Sprintf("%s.rate_adjustments.previous_bandwidth", ifc), float64(ra.PreviousBandwidth))
+			if ra.LastChange != nil {
+				out[fmt.Sprintf("%s.rate_adjustments.last_change", ifc)] = float64(ra.LastChange.Unix())
+			}
+		}
+
+		if im := rep.Imbalance; im != nil {
+			for _, ql := range im.Queues {
+				out[fmt.Sprintf("%s.imbalance.q%s.share_pct", ifc, plan.SanitizeKey(ql.QueueID))] = ql.Share
+			}
+			out[fmt.Sprintf("%s.imbalance.throughput_cv", ifc)] = im.ThroughputCV
+			out[fmt.Sprintf("%s.imbalance.peak_max_over_mean", ifc)] = im.PeakMaxOverMean
+			if n, ok := im.BusiestQueueNumber(); ok {
+				setMetric(out, fmt.Sprintf("%s.imbalance.busiest_queue", ifc), n)
+			}
+		}
+
+		for _, q := range rep.Queues {
+			qid := plan.SanitizeKey(q.QueueID)
+			if qid == "" {
+				qid = "0"
+			}
+
+			if r := q.Overview.Rates; r != nil && rep.Mode != sqm.ModeCakeMQ {
+				setRatioMetrics(out, fmt.Sprintf("%s.q%s", ifc, qid), r)
+			}
+
+			for _, tin := range q.Tins {
+				tn := strings.ToLower(plan.SanitizeKey(tin.Tin))
+
+				var base string
+				switch rep.Mode {
+				case sqm.ModeOverlay:
+					base = fmt.Sprintf("%s.%s.q%s", ifc, tn, qid)
+				case sqm.ModeQueue:
+					base = fmt.Sprintf("%s.q%s.%s", ifc, qid, tn)
+				default:
+					base = fmt.Sprintf("%s.%s", ifc, tn)
+				}
+
+				setMetric(out, base+".traffic.bytes", tin.SentBytes)
+				setTraffic(base+".traffic.thres", float64(tin.ThresholdRate))
+				setMetric(out, base+".traffic.packets", tin.SentPackets)
+				setLatency(base+".latency.target", float64(tin.TargetUS))
+				setLatency(base+".latency.peak", float64(tin.PeakDelayUS))
+				setLatency(base+".latency.avg", float64(tin.AvgDelayUS))
+				setLatency(base+".latency.sparse", float64(tin.BaseDelayUS))
+				if ls := tin.LatencyStats; ls != nil {
+					setLatency(base+".latency.peak_window_min", float64(ls.Peak.MinUS))
+					setLatency(base+".latency.peak_window_mean", ls.Peak.MeanUS)
+					setLatency(base+".latency.peak_window_max", float64(ls.Peak.MaxUS))
+					setLatency(base+".latency.peak_window_p95", float64(ls.Peak.P95US))
+					setLatency(base+".latency.avg_window_min", float64(ls.Avg.MinUS))
+					setLatency(base+".latency.avg_window_mean", ls.Avg.MeanUS)
+					setLatency(base+".latency.avg_window_max", float64(ls.Avg.MaxUS))
+					setLatency(base+".latency.avg_window_p95", float64(ls.Avg.P95US))
+				}
+				if sp := tin.Spread; sp != nil {
+					setLatency(base+".latency.target_min", float64(sp.TargetMinUS))
+					setLatency(base+".latency.target_max", float64(sp.TargetMaxUS))
+					setLatency(base+".latency.peak_min", float64(sp.PeakMinUS))
+					setLatency(base+".latency.peak_max", float64(sp.PeakMaxUS))
+					setLatency(base+".latency.avg_min", float64(sp.AvgMinUS))
+					setLatency(base+".latency.avg_max", float64(sp.AvgMaxUS))
+					setLatency(base+".latency.sparse_min", float64(sp.BaseMinUS))
+					setLatency(base+".latency.sparse_max", float64(sp.BaseMaxUS))
+				}
+				setMetric(out, base+".drops.ack", tin.AckDrops)
+				setMetric(out, base+".drops.drops", tin.Drops)
+				setMetric(out, base+".drops.ecn", tin.ECNMark)
+				setMetric(out, base+".backlog.bytes", tin.BacklogBytes)
+				setMetric(out, base+".flows.sparse", tin.SparseFlows)
+				setMetric(out, base+".flows.bulk", tin.BulkFlows)
+				setMetric(out, base+".flows.unresponsive", tin.UnresponsiveFlows)
+				if r := tin.Rates; r != nil {
+					setTraffic(base+".traffic.bytes_rate", r.SentBytes)
+					out[base+".traffic.packets_rate"] = r.SentPackets
+					out[base+".traffic.avg_packet_size"] = r.AvgPacketSize
+					out[base+".drops.ack_rate"] = r.AckDrops
+					out[base+".drops.drops_rate"] = r.Drops
+					out[base+".drops.ecn_rate"] = r.ECNMark
+					if tin.ThresholdRate > 0 {
+						out[base+".traffic.util_pct"] = r.Utilisation
+					}
+					out[base+".ratios.drop_permille"] = r.DropRatio
+					out[base+".ratios.ecn_permille"] = r.ECNRatio
+					out[base+".ratios.ack_permille"] = r.AckRatio
+				}
+			}
+		}
+	}
+
+	return out
+}
+
+// NetdataCreate writes the CHART and DIMENSION lines of every chart in p.
+// Chart priorities are offsets from priority.
+func NetdataCreate(w io.Writer, p plan.Plan, priority, updateEvery int) error {
+	bw := bufio.NewWriter(w)
+	for i := range p.Charts {
+		writeChart(bw, p.Charts[i], priority, updateEvery, false)
+		for _, d := range p.Charts[i].Dims {
+			writeDimension(bw, d, false)
+		}
+	}
+	return bw.Flush()
+}
+
+// NetdataChanges writes the CHART and DIMENSION lines that turn the charts of
+// prev into those of next (see plan.Diff): definitions of new and changed
+// charts and dimensions, and obsolete charts and dimensions. With an empty
+// prev it writes the same lines as NetdataCreate.
+func NetdataChanges(w io.Writer, prev, next plan.Plan, priority, updateEvery int) error {
+	bw := bufio.NewWriter(w)
+	for _, ch := range plan.Diff(prev, next) {
+		writeChart(bw, ch.Chart, priority, updateEvery, ch.Obsolete)
+		for _, d := range ch.Dims {
+			writeDimension(bw, d, false)
+		}
+		for _, d := range ch.ObsoleteDims {
+			writeDimension(bw, d, true)
+		}
+	}
+	return bw.Flush()
+}
+
+func writeChart(w io.Writer, chart plan.Chart, priority, updateEvery int, obsolete bool) {
+	if updateEvery <= 0 {
+		updateEvery = 1
+	}
+	chartType := chart.Type
+	if chartType == "" {
+		chartType = "line"
+	}
+	options := chart.Options
+	if obsolete && !slices.Contains(options, "obsolete") {
+		options = append(slices.Clip(options), "obsolete")
+	}
+	fmt.Fprintf(w, "CHART \"%s\" '' \"%s\" '%s' \"%s\" '%s' %s %d %d", chart.ID, chart.Title, chart.Units, chart.Family, chart.Context, chartType, priority+chart.Priority, updateEvery)
+	if len(options) > 0 {
+		fmt.Fprintf(w, " '%s'", strings.Join(options, " "))
+	}
+	fmt.Fprintln(w)
+}
+
+func writeDimension(w io.Writer, d plan.Dimension, obsolete bool) {
+	mul := d.Mul
+	div := d.Div
+	if mul == 0 {
+		mul = 1
+	}
+	if div == 0 {
+		div = 1
+	}
+	fmt.Fprintf(w, "DIMENSION '%s' '%s' %s %d %d", d.ID, d.Name, d.Algo, mul, div)
+	if obsolete {
+		fmt.Fprint(w, " 'obsolete'")
+	}
+	fmt.Fprintln(w)
+}
+
+// NetdataUpdate writes a BEGIN/SET/END block for every chart with values in p.
+// Chart variables are set inside their chart's block and host variables after
+// the last block.
+func NetdataUpdate(w io.Writer, p plan.Plan, microseconds int64) error {
+	bw := bufio.NewWriter(w)
+	chartVars := make(map[string][]plan.Variable)
+	var hostVars []plan.Variable
+	for _, v := range p.Variables {
+		if v.Chart == "" {
+			hostVars = append(hostVars, v)
+		} else {
+			chartVars[v.Chart] = append(chartVars[v.Chart], v)
+		}
+	}
+
+	order := sortedChartIDs(p.Updates)
+	for _, chartID := range order {
+		fmt.Fprintf(bw, "BEGIN \"%s\" %d\n", chartID, microseconds)
+		dims := p.Updates[chartID]
+		dimIDs := make([]string, 0, len(dims))
+		for dimID := range dims {
+			dimIDs = append(dimIDs, dimID)
+		}
+		sort.Strings(dimIDs)
+		for _, dimID := range dimIDs {
+			fmt.Fprintf(bw, "SET '%s' = %d\n", dimID, dims[dimID])
+		}
+		for _, v := range chartVars[chartID] {
+			fmt.Fprintf(bw, "VARIABLE CHART %s = %s\n", v.Name, strconv.FormatFloat(v.Value, 'f', -1, 64))
+		}
+		fmt.Fprintln(bw, "END")
+	}
+	for _, v := range hostVars {
+		fmt.Fprintf(bw, "VARIABLE HOST %s = %s\n", v.Name, strconv.FormatFloat(v.Value, 'f', -1, 64))
+	}
+	return bw.Flush()
+}
+
+func sortedChartIDs(updates map[string]map[string]uint64) []string {
+	order := make([]string, 0, len(updates))
+	for chartID := range updates {
+		order = append(order, chartID)
+	}
+	sort.Strings(order)
+	return order
+}
+
+func setRatioMetrics(m map[string]float64, base string, r *sqm.OverviewRates) {
+	m[base+".ratios.drop_permille"] = r.DropRatio
+	m[base+".ratios.ecn_permille"] = r.ECNRatio
+	m[base+".ratios.ack_permille"] = r.AckRatio
+}
+
+func setMetric(m map[string]float64, k string, v uint64) {
+	m[k] = float64(v)
+}
@@ -0,0 +1,397 @@
+package emit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/plan"
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/sqm"
+)
+
+func TestNetdataCreateAndUpdate(t *testing.T) {
+	p := plan.Plan{
+		Charts: []plan.Chart{
+			{
+				ID:       "SQM.eth0_overview",
+				Title:    "SQM qdisc eth0 Overview",
+				Units:    "mixed",
+				Family:   "eth0 Qdisc",
+				Context:  "overview",
+				Type:     "area",
+				Priority: 3,
+				Options:  []string{"detail", "store_first"},
+				Dims: []plan.Dimension{
+					{ID: "bytes", Name: "Bytes", Algo: "incremental", Mul: 1, Div: 1},
+				},
+			},
+		},
+		Updates: map[string]map[string]uint64{
+			"SQM.eth0_overview": {"bytes": 1234},
+		},
+		Variables: []plan.Variable{
+			{Name: "sqm_eth0_bandwidth", Value: 2500000},
+			{Chart: "SQM.eth0_overview", Name: "bandwidth", Value: 2500000},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := NetdataCreate(&buf, p, 90000, 1); err != nil {
+		t.Fatalf("NetdataCreate: %v", err)
+	}
+	createOut := buf.String()
+	if !strings.Contains(createOut, `CHART "SQM.eth0_overview" '' "SQM qdisc eth0 Overview" 'mixed' "eth0 Qdisc" 'overview' area 90003 1 'detail store_first'`+"\n") {
+		t.Fatalf("missing CHART line in create output: %s", createOut)
+	}
+	if !strings.Contains(createOut, `DIMENSION 'bytes' 'Bytes' incremental 1 1`) {
+		t.Fatalf("missing DIMENSION line in create output: %s", createOut)
+	}
+
+	buf.Reset()
+	if err := NetdataUpdate(&buf, p, 1000000); err != nil {
+		t.Fatalf("NetdataUpdate: %v", err)
+	}
+	updateOut := buf.String()
+	if !strings.Contains(updateOut, `BEGIN "SQM.eth0_overview" 1000000`) {
+		t.Fatalf("missing BEGIN line in update output: %s", updateOut)
+	}
+	if !strings.Contains(updateOut, `SET 'bytes' = 1234`) {
+		t.Fatalf("missing SET line in update output: %s", updateOut)
+	}
+	if !strings.Contains(updateOut, "END") {
+		t.Fatalf("missing END line in update output: %s", updateOut)
+	}
+	if !strings.Contains(updateOut, "SET 'bytes' = 1234\nVARIABLE CHART bandwidth = 2500000\nEND\nVARIABLE HOST sqm_eth0_bandwidth = 2500000\n") {
+		t.Fatalf("unexpected variables in update output: %s", updateOut)
+	}
+}
+
+func TestNetdataChanges(t *testing.T) {
+	overview := plan.Chart{
+		ID: "SQM.eth0_overview", Title: "Overview", Units: "mixed", Family: "eth0 Qdisc", Context: "overview", Type: "area", Priority: 1,
+		Dims: []plan.Dimension{{ID: "bytes", Name: "Bytes", Algo: "incremental", Mul: 1, Div: 1}},
+	}
+	be := plan.Chart{
+		ID: "SQM.eth0_BE_traffic", Title: "BE", Units: "Kb/s", Family: "eth0 BE", Context: "traffic", Type: "area", Priority: 2,
+		Dims: []plan.Dimension{{ID: "q1_bytes", Name: "Q1_Bytes", Algo: "incremental", Mul: 8, Div: 1000}},
+	}
+	prev := plan.Plan{Charts: []plan.Chart{overview, be}}
+
+	var created, changed bytes.Buffer
+	if err := NetdataCreate(&created, prev, 90000, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := NetdataChanges(&changed, plan.Plan{}, prev, 90000, 1); err != nil {
+		t.Fatal(err)
+	}
+	if created.String() != changed.String() {
+		t.Fatalf("changes from an empty plan differ from create:\n%s\n%s", created.String(), changed.String())
+	}
+
+	changed.Reset()
+	if err := NetdataChanges(&changed, prev, prev, 90000, 1); err != nil || changed.Len() != 0 {
+		t.Fatalf("unchanged plan wrote %q (%v)", changed.String(), err)
+	}
+
+	ov := overview
+	ov.Dims = append([]plan.Dimension{}, overview.Dims...)
+	ov.Dims = append(ov.Dims, plan.Dimension{ID: "drops", Name: "Drops", Algo: "incremental", Mul: 1, Div: 1})
+	changed.Reset()
+	if err := NetdataChanges(&changed, prev, plan.Plan{Charts: []plan.Chart{ov}}, 90000, 1); err != nil {
+		t.Fatal(err)
+	}
+	want := `CHART "SQM.eth0_overview" '' "Overview" 'mixed' "eth0 Qdisc" 'overview' area 90001 1` + "\n" +
+		"DIMENSION 'drops' 'Drops' incremental 1 1\n" +
+		`CHART "SQM.eth0_BE_traffic" '' "BE" 'Kb/s' "eth0 BE" 'traffic' area 90002 1 'obsolete'` + "\n"
+	if changed.String() != want {
+		t.Fatalf("unexpected changes:\n%s\nwant:\n%s", changed.String(), want)
+	}
+
+	changed.Reset()
+	if err := NetdataChanges(&changed, prev, plan.Plan{Charts: []plan.Chart{overview, {ID: be.ID, Title: be.Title, Units: be.Units, Family: be.Family, Context: be.Context, Type: be.Type, Priority: be.Priority}}}, 90000, 1); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(changed.String(), "DIMENSION 'q1_bytes' 'Q1_Bytes' incremental 8 1000 'obsolete'\n") {
+		t.Fatalf("expected an obsolete dimension:\n%s", changed.String())
+	}
+}
+
+func TestFlattenMetrics(t *testing.T) {
+	in := sqm.Result{Reports: []sqm.InterfaceReport{{
+		Interface: "eth0",
+		Mode:      sqm.ModeOverlay,
+		Overview:  sqm.Overview{Overlimits: 7, Rates: &sqm.OverviewRates{}},
+		Queues: []sqm.QueueReport{{
+			QueueID:  "1",
+			Overview: sqm.Overview{Rates: &sqm.OverviewRates{DropRatio: 5}},
+			Tins:     []sqm.TinMetrics{{Tin: "BE", PeakDelayUS: 800, ThresholdRate: 125000, SentBytes: 9000, Rates: &sqm.TinRates{SentBytes: 62500}}},
+		}},
+	}}}
+
+	m := FlattenMetrics(in, plan.Unit{}, plan.Unit{})
+	if got := m["eth0.overview.overlimits"]; got != 7 {
+		t.Fatalf("overlimits metric = %v, want 7", got)
+	}
+	if got := m["eth0.q1.ratios.drop_permille"]; got != 5 {
+		t.Fatalf("queue drop ratio metric = %v, want 5", got)
+	}
+	if got := m["eth0.be.q1.latency.peak"]; got != 800 {
+		t.Fatalf("overlay peak metric = %v, want 800", got)
+	}
+	if got := m["eth0.be.q1.traffic.bytes_rate"]; got != 62500 {
+		t.Fatalf("tin rate metric = %v, want 62500", got)
+	}
+	if got := m["eth0.be.q1.traffic.bytes"]; got != 9000 {
+		t.Fatalf("byte counter = %v, want 9000", got)
+	}
+
+	m = FlattenMetrics(in, plan.TrafficUnits["mbyte"], plan.LatencyUnits["ms"])
+	if got := m["eth0.be.q1.latency.peak_ms"]; got != 0.8 {
+		t.Fatalf("overlay peak metric in ms = %v, want 0.8", got)
+	}
+	if got := m["eth0.be.q1.traffic.thres_mbyte"]; got != 0.125 {
+		t.Fatalf("threshold metric in MB/s = %v, want 0.125", got)
+	}
+	if got := m["eth0.be.q1.traffic.rate_mbyte"]; got != 0.0625 {
+		t.Fatalf("tin rate metric in MB/s = %v, want 0.0625", got)
+	}
+	if _, ok := m["eth0.be.q1.latency.peak"]; ok {
+		t.Fatalf("metrics in base units must not be emitted with a unit set: %v", m)
+	}
+}
+
+// TestFlattenMetricsDefaultKeys pins the traffic and latency keys of metrics
+// output without -traffic-units and -latency-units to the names and base units
+// consumers of earlier versions rely on.
+func TestFlattenMetricsDefaultKeys(t *testing.T) {
+	in := sqm.Result{Reports: []sqm.InterfaceReport{{
+		Interface:       "eth0",
+		Mode:            sqm.ModeCakeMQ,
+		Overview:        sqm.Overview{Rates: &sqm.OverviewRates{Bytes: 1000}},
+		Bufferbloat:     &sqm.Bufferbloat{Samples: 1, LatencyUS: 3000, PeakLatencyUS: 4000},
+		RateAdjustments: &sqm.RateAdjustments{Bandwidth: 12500000, PreviousBandwidth: 6250000},
+		Queues: []sqm.QueueReport{{QueueID: "all", Tins: []sqm.TinMetrics{{
+			Tin: "BE", ThresholdRate: 125000, TargetUS: 5000, PeakDelayUS: 800, AvgDelayUS: 400, BaseDelayUS: 80,
+			LatencyStats: &sqm.LatencyStats{},
+			Spread:       &sqm.TinSpread{},
+			Rates:        &sqm.TinRates{SentBytes: 62500},
+		}}}},
+	}}}
+
+	want := map[string]float64{
+		"eth0.overview.bytes_rate":                 1000,
+		"eth0.bufferbloat.latency_us":              3000,
+		"eth0.bufferbloat.peak_latency_us":         4000,
+		"eth0.rate_adjustments.bandwidth":          12500000,
+		"eth0.rate_adjustments.previous_bandwidth": 6250000,
+		"eth0.be.traffic.thres":                    125000,
+		"eth0.be.traffic.bytes_rate":               62500,
+		"eth0.be.latency.target":                   5000,
+		"eth0.be.latency.peak":                     800,
+		"eth0.be.latency.avg":                      400,
+		"eth0.be.latency.sparse":                   80,
+		"eth0.be.latency.peak_window_min":          0,
+		"eth0.be.latency.peak_window_mean":         0,
+		"eth0.be.latency.peak_window_max":          0,
+		"eth0.be.latency.peak_window_p95":          0,
+		"eth0.be.latency.avg_window_min":           0,
+		"eth0.be.latency.avg_window_mean":          0,
+		"eth0.be.latency.avg_window_max":           0,
+		"eth0.be.latency.avg_window_p95":           0,
+		"eth0.be.latency.target_min":               0,
+		"eth0.be.latency.target_max":               0,
+		"eth0.be.latency.peak_min":                 0,
+		"eth0.be.latency.peak_max":                 0,
+		"eth0.be.latency.avg_min":                  0,
+		"eth0.be.latency.avg_max":                  0,
+		"eth0.be.latency.sparse_min":               0,
+		"eth0.be.latency.sparse_max":               0,
+	}
+	m := FlattenMetrics(in, plan.Unit{}, plan.Unit{})
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s = %v (present %v), want %v", k, got, ok, v)
+		}
+	}
+	for k := range m {
+		for _, u := range []map[string]plan.Unit{plan.TrafficUnits, plan.LatencyUnits} {
+			for name := range u {
+				if strings.HasSuffix(k, "_"+name) && k != "eth0.bufferbloat.latency_us" && k != "eth0.bufferbloat.peak_latency_us" {
+					t.Errorf("unexpected unit-suffixed key %s", k)
+				}
+			}
+		}
+	}
+}
+
+func TestTable(t *testing.T) {
+	tin := sqm.TinMetrics{Tin: "BE", ThresholdRate: 12500000, TargetUS: 5000, PeakDelayUS: 1250, AvgDelayUS: 400, BaseDelayUS: 80, Drops: 1500, BulkFlows: 2}
+	in := sqm.Result{Reports: []sqm.InterfaceReport{{
+		Interface: "eth0", Mode: sqm.ModeCakeMQ, RootKind: "cake", RootHandle: "1:", Bandwidth: 12500000,
+		Queues: []sqm.QueueReport{{QueueID: "root", Tins: []sqm.TinMetrics{tin}}},
+	}}}
+
+	var buf bytes.Buffer
+	if err := Table(&buf, in); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	if lines[0] != "eth0  cake 1:  mode cake_mq  bandwidth 100 Mbit/s  backlog 0 B  drops 0" {
+		t.Fatalf("unexpected summary line %q", lines[0])
+	}
+	if got := strings.Fields(lines[2]); strings.Join(got, " ") != "root BE - 100 Mbit/s - 5ms 1.25ms 400us 80us 0 B 1.5K 0 0 0 2 0" {
+		t.Fatalf("unexpected tin row %q", lines[2])
+	}
+
+	rates := tin
+	rates.Rates = &sqm.TinRates{SentBytes: 1250000, Utilisation: 10, Drops: 0.5}
+	in.Reports[0].Queues[0].Tins[0] = rates
+	buf.Reset()
+	if err := Table(&buf, in); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "10 Mbit/s  100 Mbit/s  10%") || !strings.Contains(buf.String(), "0.5/s") {
+		t.Fatalf("expected rates in table:\n%s", buf.String())
+	}
+}
+
+func TestJSONL(t *testing.T) {
+	in := sqm.Result{IntervalSeconds: 2, Reports: []sqm.InterfaceReport{{
+		Interface: "eth0",
+		Mode:      sqm.ModeCakeMQ,
+		Overview:  sqm.Overview{Bytes: 4000, Rates: &sqm.OverviewRates{Bytes: 2000}},
+		Queues:    []sqm.QueueReport{{QueueID: "all", Tins: []sqm.TinMetrics{{Tin: "BE", SentBytes: 4000}}}},
+	}}}
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var buf bytes.Buffer
+	e, _ := Lookup("jsonl")
+	if err := e.Emit(&buf, in, Options{Pretty: true, Time: now, Monotonic: 1500 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(buf.String(), "\n") != 1 {
+		t.Fatalf("expected one line, got %q", buf.String())
+	}
+	var rec Record
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if !rec.Time.Equal(now) || rec.UnixMS != now.UnixMilli() || rec.MonotonicNS != 1500000000 || rec.IntervalSeconds != 2 {
+		t.Fatalf("unexpected timestamps: %+v", rec)
+	}
+	if rec.Rates["eth0.overview.bytes_rate"] != 2000 || len(rec.Rates) == 0 {
+		t.Fatalf("unexpected rates: %v", rec.Rates)
+	}
+	if _, ok := rec.Rates["eth0.overview.bytes"]; ok {
+		t.Fatalf("counter in rates: %v", rec.Rates)
+	}
+	if len(rec.Result.Reports) != 1 || rec.Result.Reports[0].Overview.Bytes != 4000 {
+		t.Fatalf("unexpected result: %+v", rec.Result)
+	}
+
+	// One-shot runs have no collector start to measure from.
+	buf.Reset()
+	if err := e.Emit(&buf, in, Options{Time: now}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "monotonic_ns") || !strings.Contains(buf.String(), `"unix_ms":`) {
+		t.Fatalf("one-shot records must omit monotonic_ns: %s", buf.String())
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	want := []string{"json", "metrics", "plan", "netdata-create", "netdata-update", "table", "jsonl", "netdata-health"}
+	if got := Names(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("Names() = %v, want %v", got, want)
+	}
+	if _, ok := Lookup("bogus"); ok {
+		t.Fatalf("unexpected emitter for unknown format")
+	}
+
+	Register("test-count", EmitterFunc(func(w io.Writer, out sqm.Result, opts Options) error {
+		_, err := io.WriteString(w, strings.Repeat("x", len(out.Reports)))
+		return err
+	}))
+	e, ok := Lookup("test-count")
+	if !ok {
+		t.Fatalf("registered emitter not found")
+	}
+	var buf bytes.Buffer
+	if err := e.Emit(&buf, sqm.Result{Reports: make([]sqm.InterfaceReport, 2)}, Options{}); err != nil {
+		t.Fatalf("Emit: %v", err)
+	}
+	if buf.String() != "xx" {
+		t.Fatalf("custom emitter output = %q, want %q", buf.String(), "xx")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected panic on duplicate registration")
+		}
+	}()
+	Register("json", EmitterFunc(func(io.Writer, sqm.Result, Options) error { return nil }))
+}
+
+func TestNetdataHealth(t *testing.T) {
+	tpl, err := plan.ParseTemplates([]byte(`{"interfaces": {"eth1": {"latency": {"context": "sqm_wan_latency"}}}}`))
+	if err != nil {
+		t.Fatalf("ParseTemplates: %v", err)
+	}
+	tins := []sqm.TinMetrics{{Tin: "BE"}}
+	in := sqm.Result{Reports: []sqm.InterfaceReport{
+		{Interface: "eth0", Mode: sqm.ModeCakeMQ, Queues: []sqm.QueueReport{{QueueID: "all", Tins: tins}}},
+		{Interface: "eth1", Mode: sqm.ModeCakeMQ, Queues: []sqm.QueueReport{{QueueID: "all", Tins: tins}}},
+		{Interface: "eth2", Mode: sqm.ModeOverlay, RootKind: "cake_mq", Queues: []sqm.QueueReport{{QueueID: "1", Tins: tins}, {QueueID: "2", Tins: tins}}},
+	}}
+	h, err := ParseHealthThresholds("latency-warn=2.5, drop-crit=20, backlog-window=90s")
+	if err != nil {
+		t.Fatalf("ParseHealthThresholds: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := NetdataHealth(&buf, plan.Config{Templates: tpl}.Build(in), h); err != nil {
+		t.Fatalf("NetdataHealth: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"  template: sqm_peak_latency_latency\n        on: latency\n",
+		"  template: sqm_peak_latency_sqm_wan_latency\n        on: sqm_wan_latency\n",
+		"      warn: $this > $tg * 2.5\n      crit: $this > $tg * 6\n",
+		"  template: sqm_drop_ratio\n        on: ratios\n",
+		"     units: permille\n",
+		"      crit: $this > 20\n",
+		"    lookup: min -90s unaligned of backlog\n",
+		"  template: sqm_collector_stale\n        on: overview\n",
+		"  template: sqm_collector_failed\n        on: overview\n",
+		"      calc: $sqm_collector_failures\n",
+		"    charts: SQM.*\n",
+		"  template: sqm_peak_latency_latency_q1\n        on: latency\n",
+		"    lookup: average -5m unaligned of q1_pk\n",
+		"      warn: $this > $q2_tg * 2.5\n      crit: $this > $q2_tg * 6\n",
+		"  template: sqm_drop_ratio_q2\n        on: ratios\n",
+		"    lookup: average -5m unaligned of q2_drop\n",
+		"    lookup: min -90s unaligned of q1_backlog\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("health output missing %q:\n%s", want, out)
+		}
+	}
+
+	if strings.Contains(out, "sqm_peak_latency_sqm_wan_latency_q") {
+		t.Fatalf("cake_mq-only context must not get per-queue templates:\n%s", out)
+	}
+
+	buf.Reset()
+	if err := NetdataCollectorStatus(&buf, 3); err != nil || buf.String() != "VARIABLE HOST sqm_collector_failures = 3\n" {
+		t.Fatalf("NetdataCollectorStatus = %q, %v", buf.String(), err)
+	}
+
+	for _, bad := range []string{"latency-warn", "latency-warn=-1", "drop-window=5", "noise=1"} {
+		if _, err := ParseHealthThresholds(bad); err == nil {
+			t.Fatalf("ParseHealthThresholds(%q): expected error", bad)
+		}
+	}
+}
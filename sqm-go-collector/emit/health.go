@@ -0,0 +1,313 @@
+package emit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/plan"
+)
+
+// HealthThresholds configures the alert templates of NetdataHealth.
+type HealthThresholds struct {
+	// LatencyWarn and LatencyCrit are multiples of the tin target the peak
+	// delay, averaged over LatencyWindow, must exceed.
+	LatencyWarn   float64
+	LatencyCrit   float64
+	LatencyWindow time.Duration
+	// DropWarn and DropCrit are tin drop ratios in per-mille, averaged over
+	// DropWindow.
+	DropWarn   float64
+	DropCrit   float64
+	DropWindow time.Duration
+	// BacklogWindow is how long a tin backlog must stay non-zero.
+	BacklogWindow time.Duration
+}
+
+// DefaultHealthThresholds are the thresholds used when none are given.
+var DefaultHealthThresholds = HealthThresholds{
+	LatencyWarn:   3,
+	LatencyCrit:   6,
+	LatencyWindow: 5 * time.Minute,
+	DropWarn:      10,
+	DropCrit:      50,
+	DropWindow:    5 * time.Minute,
+	BacklogWindow: 5 * time.Minute,
+}
+
+// ParseHealthThresholds parses comma-separated name=value pairs over
+// DefaultHealthThresholds. Names are latency-warn, latency-crit, drop-warn and
+// drop-crit (numbers) and latency-window, drop-window and backlog-window
+// (durations of at least one second).
+func ParseHealthThresholds(v string) (HealthThresholds, error) {
+	h := DefaultHealthThresholds
+	for _, pair := range strings.Split(v, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, raw, ok := strings.Cut(pair, "=")
+		if !ok {
+			return HealthThresholds{}, fmt.Errorf("invalid threshold %q (expected name=value)", pair)
+		}
+		name, raw = strings.TrimSpace(name), strings.TrimSpace(raw)
+		switch name {
+		case "latency-warn", "latency-crit", "drop-warn", "drop-crit":
+			f, err := strconv.ParseFloat(raw, 64)
+			if err != nil || f <= 0 {
+				return HealthThresholds{}, fmt.Errorf("invalid %s value %q (expected a positive number)", name, raw)
+			}
+			switch name {
+			case "latency-warn":
+				h.LatencyWarn = f
+			case "latency-crit":
+				h.LatencyCrit = f
+			case "drop-warn":
+				h.DropWarn = f
+			case "drop-crit":
+				h.DropCrit = f
+			}
+		case "latency-window", "drop-window", "backlog-window":
+			d, err := time.ParseDuration(raw)
+			if err != nil || d < time.Second {
+				return HealthThresholds{}, fmt.Errorf("invalid %s value %q (expected a duration of at least 1s)", name, raw)
+			}
+			switch name {
+			case "latency-window":
+				h.LatencyWindow = d
+			case "drop-window":
+				h.DropWindow = d
+			case "backlog-window":
+				h.BacklogWindow = d
+			}
+		default:
+			return HealthThresholds{}, fmt.Errorf("invalid threshold %q (expected latency-warn|latency-crit|latency-window|drop-warn|drop-crit|drop-window|backlog-window)", name)
+		}
+	}
+	return h, nil
+}
+
+// CollectorFailuresVariable is the Netdata host variable holding the number of
+// consecutive failed collections; see NetdataCollectorStatus.
+const CollectorFailuresVariable = "sqm_collector_failures"
+
+// NetdataCollectorStatus writes the collector status host variable: the
+// number of consecutive failed collections, zero after a successful one.
+func NetdataCollectorStatus(w io.Writer, failures int) error {
+	_, err := fmt.Fprintf(w, "VARIABLE HOST %s = %d\n", CollectorFailuresVariable, failures)
+	return err
+}
+
+// healthAlert is one alert template before it is bound to the contexts of a
+// plan. Alerts with a dim look it up on every chart of their group; warn and
+// crit may refer to the tin target as $tg. On overlay charts, whose dimension
+// IDs carry a q<id>_ prefix, one template is written per queue with the
+// prefix applied to dim and $tg.
+type healthAlert struct {
+	name   string
+	group  string
+	class  string
+	lookup string
+	dim    string
+	calc   string
+	every  string
+	units  string
+	warn   string
+	crit   string
+	delay  string
+	info   string
+}
+
+// NetdataHealth writes Netdata health.d alert templates for the charts of p:
+// peak latency above the tin target, tin drop ratio, stuck tin backlog, failed
+// collections and stale collection. Templates are keyed on the chart contexts
+// of p, so contexts changed by chart templates are followed, and limited to SQM
+// charts.
+func NetdataHealth(w io.Writer, p plan.Plan, h HealthThresholds) error {
+	alerts := []healthAlert{
+		{
+			name:   "sqm_peak_latency",
+			class:  "Latency",
+			group:  "latency",
+			lookup: fmt.Sprintf("average -%s unaligned", healthDuration(h.LatencyWindow)),
+			dim:    "pk",
+			every:  "1m",
+			warn:   fmt.Sprintf("$this > $tg * %s", healthNumber(h.LatencyWarn)),
+			crit:   fmt.Sprintf("$this > $tg * %s", healthNumber(h.LatencyCrit)),
+			delay:  "down 5m multiplier 1.5 max 1h",
+			info:   fmt.Sprintf("CAKE tin peak delay averaged over %s, compared with the tin target", healthDuration(h.LatencyWindow)),
+		},
+		{
+			name:   "sqm_drop_ratio",
+			class:  "Errors",
+			group:  "ratios",
+			lookup: fmt.Sprintf("average -%s unaligned", healthDuration(h.DropWindow)),
+			dim:    "drop",
+			every:  "1m",
+			warn:   fmt.Sprintf("$this > %s", healthNumber(h.DropWarn)),
+			crit:   fmt.Sprintf("$this > %s", healthNumber(h.DropCrit)),
+			delay:  "down 5m multiplier 1.5 max 1h",
+			info:   fmt.Sprintf("CAKE tin drop ratio averaged over %s", healthDuration(h.DropWindow)),
+		},
+		{
+			name:   "sqm_backlog_stuck",
+			class:  "Utilization",
+			group:  "backlog",
+			lookup: fmt.Sprintf("min -%s unaligned", healthDuration(h.BacklogWindow)),
+			dim:    "backlog",
+			every:  "1m",
+			warn:   "$this > 0",
+			delay:  "down 5m",
+			info:   fmt.Sprintf("CAKE tin backlog has not drained for %s", healthDuration(h.BacklogWindow)),
+		},
+		{
+			name:  "sqm_collector_failed",
+			class: "Errors",
+			group: "overview",
+			calc:  "$" + CollectorFailuresVariable,
+			every: "10s",
+			units: "failures",
+			warn:  "$this > 0",
+			crit:  "$this >= 5",
+			delay: "down 1m",
+			info:  "consecutive failed qdisc collections of the SQM collector daemon",
+		},
+		{
+			name:  "sqm_collector_stale",
+			class: "Errors",
+			group: "overview",
+			calc:  "$now - $last_collected_t",
+			every: "10s",
+			units: "seconds ago",
+			warn:  "$this > (($status >= $WARNING) ? ($update_every) : (5 * $update_every))",
+			crit:  "$this > (($status == $CRITICAL) ? ($update_every) : (60 * $update_every))",
+			info:  "time since the SQM collector last updated the qdisc overview",
+		},
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# SQM alert templates generated by sqm-go-collector -format netdata-health.")
+	fmt.Fprintln(bw, "# Install as /etc/netdata/health.d/sqm.conf and reload Netdata health.")
+	for _, a := range alerts {
+		contexts := healthContexts(p, a.group)
+		for _, ctx := range contexts {
+			name := a.name
+			if len(contexts) > 1 || ctx != a.group {
+				name += "_" + plan.SanitizeKey(ctx)
+			}
+			units := a.units
+			if units == "" {
+				units = healthUnits(p, ctx)
+			}
+			prefixes := []string{""}
+			if a.dim != "" {
+				prefixes = healthDimPrefixes(p, ctx, a.dim)
+			}
+			for _, prefix := range prefixes {
+				lookup, warn, crit := a.lookup, a.warn, a.crit
+				if a.dim != "" {
+					lookup += " of " + prefix + a.dim
+					warn = strings.ReplaceAll(warn, "$tg", "$"+prefix+"tg")
+					crit = strings.ReplaceAll(crit, "$tg", "$"+prefix+"tg")
+				}
+				fmt.Fprintln(bw)
+				healthLine(bw, "template", name+strings.TrimSuffix("_"+prefix, "_"))
+				healthLine(bw, "on", ctx)
+				healthLine(bw, "class", a.class)
+				healthLine(bw, "type", "Networking")
+				healthLine(bw, "component", "SQM")
+				healthLine(bw, "charts", "SQM.*")
+				healthLine(bw, "lookup", lookup)
+				healthLine(bw, "calc", a.calc)
+				healthLine(bw, "units", units)
+				healthLine(bw, "every", a.every)
+				healthLine(bw, "warn", warn)
+				healthLine(bw, "crit", crit)
+				healthLine(bw, "delay", a.delay)
+				healthLine(bw, "info", a.info)
+				healthLine(bw, "to", "sysadmin")
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// healthDimPrefixes returns the q<id>_ prefixes of the overlay dimensions
+// dim of the charts with context ctx, sorted, with "" for charts of the other
+// modes. A context without such dimensions yields "" alone.
+func healthDimPrefixes(p plan.Plan, ctx, dim string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, c := range p.Charts {
+		if c.Context != ctx {
+			continue
+		}
+		for _, d := range c.Dims {
+			prefix, ok := strings.CutSuffix(d.ID, dim)
+			if !ok || (prefix != "" && !(strings.HasPrefix(prefix, "q") && strings.HasSuffix(prefix, "_"))) || seen[prefix] {
+				continue
+			}
+			seen[prefix] = true
+			out = append(out, prefix)
+		}
+	}
+	if len(out) == 0 {
+		return []string{""}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// healthContexts returns the contexts of the charts of group in p, or the
+// group's default context when p has none.
+func healthContexts(p plan.Plan, group string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, c := range p.Charts {
+		if c.Group == group && !seen[c.Context] {
+			seen[c.Context] = true
+			out = append(out, c.Context)
+		}
+	}
+	if len(out) == 0 {
+		return []string{group}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// healthUnits returns the units of the first chart with context ctx.
+func healthUnits(p plan.Plan, ctx string) string {
+	for _, c := range p.Charts {
+		if c.Context == ctx {
+			return c.Units
+		}
+	}
+	return ""
+}
+
+func healthLine(w io.Writer, key, value string) {
+	if value != "" {
+		fmt.Fprintf(w, "%10s: %s\n", key, value)
+	}
+}
+
+// healthDuration formats d in the units Netdata health lookups accept.
+func healthDuration(d time.Duration) string {
+	s := int64(d / time.Second)
+	switch {
+	case s%3600 == 0:
+		return fmt.Sprintf("%dh", s/3600)
+	case s%60 == 0:
+		return fmt.Sprintf("%dm", s/60)
+	default:
+		return fmt.Sprintf("%ds", s)
+	}
+}
+
+func healthNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
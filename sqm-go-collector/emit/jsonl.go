@@ -0,0 +1,64 @@
+package emit
+
+import (
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/plan"
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/sqm"
+)
+
+// Record is one line of the jsonl format. Time is the wall-clock time of the
+// sample and MonotonicNS the monotonic time since the collector started, which
+// does not jump when the wall clock is set; it is only known to the daemon and
+// omitted from one-shot runs. Rates holds the per-second rates
+// and derived metrics of FlattenMetrics, empty until a previous sample is
+// known; Result is the full sample.
+type Record struct {
+	Time            time.Time          `json:"time"`
+	UnixMS          int64              `json:"unix_ms"`
+	MonotonicNS     int64              `json:"monotonic_ns,omitempty"`
+	IntervalSeconds float64            `json:"interval_seconds"`
+	Rates           map[string]float64 `json:"rates"`
+	Result          sqm.Result         `json:"result"`
+}
+
+// NewRecord returns the jsonl record of out sampled at now, monotonic after
+// the collector started, with rates in traffic and latency units as in
+// FlattenMetrics.
+func NewRecord(out sqm.Result, now time.Time, monotonic time.Duration, traffic, latency plan.Unit) Record {
+	rates := make(map[string]float64)
+	for k, v := range FlattenMetrics(out, traffic, latency) {
+		if isRateMetric(k) {
+			rates[k] = v
+		}
+	}
+	return Record{
+		Time:            now,
+		UnixMS:          now.UnixMilli(),
+		MonotonicNS:     monotonic.Nanoseconds(),
+		IntervalSeconds: out.IntervalSeconds,
+		Rates:           rates,
+		Result:          out,
+	}
+}
+
+// JSONL writes rec as one line of JSON.
+func JSONL(w io.Writer, rec Record) error {
+	return JSON(w, rec, false)
+}
+
+// isRateMetric reports whether the FlattenMetrics key k is computed from
+// rates rather than read from a counter.
+func isRateMetric(k string) bool {
+	if strings.HasPrefix(k[strings.LastIndex(k, ".")+1:], "rate_") {
+		return true
+	}
+	for _, suffix := range []string{"_rate", ".avg_packet_size", ".util_pct", "_permille"} {
+		if strings.HasSuffix(k, suffix) {
+			return true
+		}
+	}
+	return false
+}
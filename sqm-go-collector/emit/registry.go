@@ -0,0 +1,109 @@
+package emit
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/plan"
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/sqm"
+)
+
+// Options carries the settings an emitter may use. Emitters ignore the ones
+// that do not apply to their format.
+type Options struct {
+	Pretty       bool
+	Priority     int
+	UpdateEvery  int
+	Microseconds int64
+	// Plan configures the chart plan of the plan and netdata-* formats.
+	Plan plan.Config
+	// Health sets the alert thresholds of the netdata-health format.
+	Health HealthThresholds
+	// Time is the sample time and Monotonic the monotonic time since the
+	// collector started, used by the jsonl format. A zero Time means now; a
+	// zero Monotonic (one-shot runs) is left out of the record.
+	Time      time.Time
+	Monotonic time.Duration
+}
+
+// Emitter writes one sample in an output format.
+type Emitter interface {
+	Emit(w io.Writer, out sqm.Result, opts Options) error
+}
+
+// EmitterFunc adapts a function to the Emitter interface.
+type EmitterFunc func(w io.Writer, out sqm.Result, opts Options) error
+
+// Emit calls f.
+func (f EmitterFunc) Emit(w io.Writer, out sqm.Result, opts Options) error {
+	return f(w, out, opts)
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Emitter)
+	names      []string
+)
+
+// Register makes an emitter available under name. It panics if name is
+// already registered or e is nil.
+func Register(name string, e Emitter) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if e == nil {
+		panic("emit: Register emitter is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic(fmt.Sprintf("emit: Register called twice for format %q", name))
+	}
+	registry[name] = e
+	names = append(names, name)
+}
+
+// Lookup returns the emitter registered under name.
+func Lookup(name string) (Emitter, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	e, ok := registry[name]
+	return e, ok
+}
+
+// Names returns the registered format names in registration order.
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return append([]string(nil), names...)
+}
+
+func init() {
+	Register("json", EmitterFunc(func(w io.Writer, out sqm.Result, opts Options) error {
+		return JSON(w, out, opts.Pretty)
+	}))
+	Register("metrics", EmitterFunc(func(w io.Writer, out sqm.Result, opts Options) error {
+		return JSON(w, FlattenMetrics(out, opts.Plan.TrafficUnit, opts.Plan.LatencyUnit), opts.Pretty)
+	}))
+	Register("plan", EmitterFunc(func(w io.Writer, out sqm.Result, opts Options) error {
+		return JSON(w, opts.Plan.Build(out), opts.Pretty)
+	}))
+	Register("netdata-create", EmitterFunc(func(w io.Writer, out sqm.Result, opts Options) error {
+		return NetdataCreate(w, opts.Plan.Build(out), opts.Priority, opts.UpdateEvery)
+	}))
+	Register("netdata-update", EmitterFunc(func(w io.Writer, out sqm.Result, opts Options) error {
+		return NetdataUpdate(w, opts.Plan.Build(out), opts.Microseconds)
+	}))
+	Register("table", EmitterFunc(func(w io.Writer, out sqm.Result, opts Options) error {
+		return Table(w, out)
+	}))
+	Register("jsonl", EmitterFunc(func(w io.Writer, out sqm.Result, opts Options) error {
+		now := opts.Time
+		if now.IsZero() {
+			now = time.Now()
+		}
+		return JSONL(w, NewRecord(out, now, opts.Monotonic, opts.Plan.TrafficUnit, opts.Plan.LatencyUnit))
+	}))
+	Register("netdata-health", EmitterFunc(func(w io.Writer, out sqm.Result, opts Options) error {
+		return NetdataHealth(w, opts.Plan.Build(out), opts.Health)
+	}))
+}
@@ -0,0 +1,147 @@
+package emit
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/sqm"
+)
+
+// Table writes out as human-readable text: a summary line per interface
+// followed by one row per tin of each queue with rate, threshold,
+// utilisation, delays, drops, marks and flows. Rates and utilisation need a
+// previous sample and show as "-" without one; with one, drops, ECN marks and
+// ACK drops are per-second rates instead of totals.
+func Table(w io.Writer, out sqm.Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for i, r := range out.Reports {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintln(tw, InterfaceSummary(r))
+		fmt.Fprintln(tw, "QUEUE\tTIN\tRATE\tTHRESHOLD\tUTIL\tTARGET\tPEAK\tAVG\tBASE\tBACKLOG\tDROPS\tMARKS\tACKDROP\tSPARSE\tBULK\tUNRESP")
+		for _, q := range r.Queues {
+			for _, t := range q.Tins {
+				rate, util := "-", "-"
+				drops, marks, acks := FormatCount(float64(t.Drops)), FormatCount(float64(t.ECNMark)), FormatCount(float64(t.AckDrops))
+				if tr := t.Rates; tr != nil {
+					rate = FormatRate(tr.SentBytes)
+					if t.ThresholdRate > 0 {
+						util = fmt.Sprintf("%.0f%%", tr.Utilisation)
+					}
+					drops, marks, acks = FormatCount(tr.Drops)+"/s", FormatCount(tr.ECNMark)+"/s", FormatCount(tr.AckDrops)+"/s"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\n",
+					q.QueueID, t.Tin, rate, FormatRate(float64(t.ThresholdRate)), util,
+					FormatDelay(t.TargetUS), FormatDelay(t.PeakDelayUS), FormatDelay(t.AvgDelayUS), FormatDelay(t.BaseDelayUS),
+					FormatBytes(t.BacklogBytes), drops, marks, acks,
+					t.SparseFlows, t.BulkFlows, t.UnresponsiveFlows)
+			}
+		}
+	}
+	return tw.Flush()
+}
+
+// InterfaceSummary returns the interface line of Table: root qdisc, mode,
+// bandwidth, CAKE options, rate, utilisation, backlog, drops and bufferbloat
+// grade. It has no tabs so it does not widen the first table column.
+func InterfaceSummary(r sqm.InterfaceReport) string {
+	parts := []string{r.Interface, r.RootKind + " " + r.RootHandle, "mode " + r.Mode}
+	if r.Bandwidth > 0 {
+		parts = append(parts, "bandwidth "+FormatRate(float64(r.Bandwidth)))
+	} else {
+		parts = append(parts, "bandwidth unlimited")
+	}
+	if len(r.Queues) > 0 && r.Queues[0].Options != nil {
+		o := r.Queues[0].Options
+		if o.Diffserv != "" {
+			parts = append(parts, o.Diffserv)
+		}
+		if s := o.Summary(); s != "" {
+			parts = append(parts, s)
+		}
+	}
+	if ov := r.Overview.Rates; ov != nil {
+		parts = append(parts, "rate "+FormatRate(ov.Bytes))
+		if r.Bandwidth > 0 {
+			parts = append(parts, fmt.Sprintf("util %.0f%%", ov.Utilisation))
+		}
+	}
+	parts = append(parts, "backlog "+FormatBytes(r.Overview.Backlog), "drops "+FormatCount(float64(r.Overview.Drops)))
+	if bb := r.Bufferbloat; bb != nil && bb.Samples > 0 {
+		parts = append(parts, "bufferbloat "+bb.Grade)
+	}
+	return strings.Join(parts, "  ")
+}
+
+// FormatRate formats bytes per second as bits per second with an SI prefix,
+// e.g. "12.5 Mbit/s".
+func FormatRate(bytesPerSecond float64) string {
+	return humanSI(bytesPerSecond*8, "bit/s")
+}
+
+// FormatBytes formats a byte count with a binary prefix.
+func FormatBytes(b uint64) string {
+	v := float64(b)
+	for _, unit := range []string{"B", "KiB", "MiB", "GiB"} {
+		if v < 1024 || unit == "GiB" {
+			if unit == "B" {
+				return fmt.Sprintf("%d B", b)
+			}
+			return trimFloat(v) + " " + unit
+		}
+		v /= 1024
+	}
+	return ""
+}
+
+// FormatCount formats a count with an SI prefix and no unit.
+func FormatCount(v float64) string {
+	return humanSI(v, "")
+}
+
+// humanSI scales v to an SI prefix, written the way tc does (K, M, G, T).
+func humanSI(v float64, unit string) string {
+	prefixes := []string{"", "K", "M", "G", "T"}
+	i := 0
+	for v >= 1000 && i < len(prefixes)-1 {
+		v /= 1000
+		i++
+	}
+	if unit == "" {
+		return trimFloat(v) + prefixes[i]
+	}
+	return trimFloat(v) + " " + prefixes[i] + unit
+}
+
+// FormatDelay formats microseconds as us, ms or s.
+func FormatDelay(us uint64) string {
+	switch {
+	case us < 1000:
+		return fmt.Sprintf("%dus", us)
+	case us < 1000000:
+		return trimFloat(float64(us)/1000) + "ms"
+	default:
+		return trimFloat(float64(us)/1000000) + "s"
+	}
+}
+
+// trimFloat formats v with three significant digits at most, without trailing
+// zeros.
+func trimFloat(v float64) string {
+	var s string
+	switch {
+	case v >= 100:
+		s = fmt.Sprintf("%.0f", v)
+	case v >= 10:
+		s = fmt.Sprintf("%.1f", v)
+	default:
+		s = fmt.Sprintf("%.2f", v)
+	}
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
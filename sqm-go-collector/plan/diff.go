@@ -0,0 +1,112 @@
+package plan
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// ChartChange is the change of one chart between two plans. Chart is the new
+// definition, or the old one when Obsolete is set because the chart is gone.
+// Dims holds the dimensions that are new or whose definition changed and
+// ObsoleteDims those that are gone.
+type ChartChange struct {
+	Chart        Chart       `json:"chart"`
+	Obsolete     bool        `json:"obsolete,omitempty"`
+	Dims         []Dimension `json:"dims,omitempty"`
+	ObsoleteDims []Dimension `json:"obsolete_dims,omitempty"`
+}
+
+// Diff returns the chart changes from prev to next: new charts with all their
+// dimensions, charts whose definition or dimensions changed, then charts that
+// are gone. Charts and dimensions keep the order of their plan. An empty prev
+// yields every chart of next.
+func Diff(prev, next Plan) []ChartChange {
+	old := make(map[string]Chart, len(prev.Charts))
+	for _, c := range prev.Charts {
+		old[c.ID] = c
+	}
+	var changes []ChartChange
+	for _, c := range next.Charts {
+		p, ok := old[c.ID]
+		delete(old, c.ID)
+		if !ok {
+			changes = append(changes, ChartChange{Chart: c, Dims: c.Dims})
+			continue
+		}
+		ch := ChartChange{Chart: c}
+		oldDims := make(map[string]Dimension, len(p.Dims))
+		for _, d := range p.Dims {
+			oldDims[d.ID] = d
+		}
+		for _, d := range c.Dims {
+			if od, ok := oldDims[d.ID]; !ok || od != d {
+				ch.Dims = append(ch.Dims, d)
+			}
+			delete(oldDims, d.ID)
+		}
+		for _, d := range p.Dims {
+			if _, gone := oldDims[d.ID]; gone {
+				ch.ObsoleteDims = append(ch.ObsoleteDims, d)
+			}
+		}
+		if len(ch.Dims) > 0 || len(ch.ObsoleteDims) > 0 || !sameDefinition(p, c) {
+			changes = append(changes, ch)
+		}
+	}
+	for _, c := range prev.Charts {
+		if _, gone := old[c.ID]; gone {
+			changes = append(changes, ChartChange{Chart: c, Obsolete: true})
+		}
+	}
+	return changes
+}
+
+// sameDefinition reports whether a and b have the same CHART line.
+func sameDefinition(a, b Chart) bool {
+	return a.Title == b.Title && a.Units == b.Units && a.Family == b.Family &&
+		a.Context == b.Context && a.Type == b.Type && a.Priority == b.Priority &&
+		slices.Equal(a.Options, b.Options)
+}
+
+// LoadCharts reads the charts of a plan written by SaveCharts. A missing file
+// yields an empty plan.
+func LoadCharts(path string) (Plan, error) {
+	var p Plan
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return Plan{}, err
+	}
+	return p, nil
+}
+
+// SaveCharts atomically replaces the file at path with the charts of p, the
+// part of a plan Diff compares.
+func SaveCharts(path string, p Plan) error {
+	b, err := json.Marshal(Plan{Charts: p.Charts})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,94 @@
+package plan
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Layout spaces chart priorities the way the shell collector does. Every
+// interface gets a block of InterfaceStep priorities, or QueueInterfaceStep in
+// queue mode of a cake_mq root, where every child queue gets a block of
+// QueueStep. A block starts with the overview chart, followed by TinStep
+// priorities per tin in tin order. Charts the shell collector does not have
+// follow the tin charts of their block; a chart that does not fit shares the
+// last priority of its block or tin.
+type Layout struct {
+	InterfaceStep      int `json:"interface_step"`
+	QueueInterfaceStep int `json:"queue_interface_step"`
+	QueueStep          int `json:"queue_step"`
+	TinStep            int `json:"tin_step"`
+}
+
+// DefaultLayout matches the priorities of the shell collector's sqm_create.
+var DefaultLayout = Layout{InterfaceStep: 50, QueueInterfaceStep: 500, QueueStep: 50, TinStep: 5}
+
+// tinGroups and interfaceGroups give the order of charts within a tin and
+// after the tins of a block. The first five tin groups are the shell
+// collector's charts.
+var (
+	tinGroups       = []string{"traffic", "latency", "drops", "backlog", "flows", "utilisation", "ratios"}
+	interfaceGroups = []string{"qdisc_utilisation", "qdisc_packet_size", "qdisc_ratios", "qdisc_imbalance", "qdisc_bufferbloat", "qdisc_rate_adjustments", "qdisc_bufferbloat_latency", "qdisc_busiest_queue"}
+)
+
+// ParseLayout parses comma-separated step=N pairs (steps: interface,
+// queue-interface, queue, tin) over DefaultLayout.
+func ParseLayout(v string) (Layout, error) {
+	l := DefaultLayout
+	for _, pair := range strings.Split(v, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		step, raw, ok := strings.Cut(pair, "=")
+		if !ok {
+			return Layout{}, fmt.Errorf("invalid layout %q (expected step=N)", pair)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil || n <= 0 {
+			return Layout{}, fmt.Errorf("invalid layout step value %q (expected a positive integer)", raw)
+		}
+		switch strings.TrimSpace(step) {
+		case "interface":
+			l.InterfaceStep = n
+		case "queue-interface":
+			l.QueueInterfaceStep = n
+		case "queue":
+			l.QueueStep = n
+		case "tin":
+			l.TinStep = n
+		default:
+			return Layout{}, fmt.Errorf("invalid layout step %q (expected interface|queue-interface|queue|tin)", step)
+		}
+	}
+	return l, nil
+}
+
+// orDefault replaces unset steps with those of DefaultLayout.
+func (l Layout) orDefault() Layout {
+	if l.InterfaceStep <= 0 {
+		l.InterfaceStep = DefaultLayout.InterfaceStep
+	}
+	if l.QueueInterfaceStep <= 0 {
+		l.QueueInterfaceStep = DefaultLayout.QueueInterfaceStep
+	}
+	if l.QueueStep <= 0 {
+		l.QueueStep = DefaultLayout.QueueStep
+	}
+	if l.TinStep <= 0 {
+		l.TinStep = DefaultLayout.TinStep
+	}
+	return l
+}
+
+// tinPriority returns the priority of a tin chart of group in the block at
+// start.
+func (l Layout) tinPriority(start, tin int, group string) int {
+	return start + 1 + tin*l.TinStep + min(slices.Index(tinGroups, group), l.TinStep-1)
+}
+
+// groupPriority returns the priority of an interface-level chart of group
+// placed from first on, capped at the last priority before end.
+func groupPriority(first, end int, group string) int {
+	return min(first+slices.Index(interfaceGroups, group), end-1)
+}
@@ -0,0 +1,490 @@
+// Package plan turns sqm reports into Netdata chart definitions and dimension
+// values. A Plan is independent of the output format; package emit writes it
+// as plugins.d protocol lines or JSON.
+package plan
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/sqm"
+)
+
+// Dimension is one Netdata dimension. Values are divided by Div (and
+// multiplied by Mul) by Netdata, so derived values are sent as fixed-point
+// integers.
+type Dimension struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Algo string `json:"algo"`
+	Mul  int    `json:"mul"`
+	Div  int    `json:"div"`
+}
+
+// Chart is one Netdata chart with its dimensions sorted by ID. Type is the
+// Netdata chart type, one of ChartTypes, Group the metric group (see Groups),
+// Options its Netdata chart options (from ChartOptions) and Priority the
+// chart's offset from the base priority of the plugin.
+type Chart struct {
+	ID       string      `json:"id"`
+	Title    string      `json:"title"`
+	Units    string      `json:"units"`
+	Family   string      `json:"family"`
+	Context  string      `json:"context"`
+	Group    string      `json:"group"`
+	Type     string      `json:"type"`
+	Priority int         `json:"priority"`
+	Options  []string    `json:"options"`
+	Dims     []Dimension `json:"dims"`
+}
+
+// Variable is a Netdata variable. A chart variable is in the units of its
+// chart's dimensions, so alarms can compare it with $this; a host variable is
+// in base units (bytes/s, microseconds). It is local to Chart, or a host
+// variable when Chart is empty.
+type Variable struct {
+	Chart string  `json:"chart,omitempty"`
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+}
+
+// Plan holds the charts of a sample, sorted by priority and ID, the dimension
+// values keyed by chart and dimension ID and the shaper limits as variables,
+// sorted by chart and name. A chart may have no values yet, e.g. when its
+// rates need a previous sample.
+type Plan struct {
+	Charts    []Chart                      `json:"charts"`
+	Updates   map[string]map[string]uint64 `json:"updates"`
+	Variables []Variable                   `json:"variables"`
+}
+
+// Config controls how reports are planned. The zero value plans the default
+// charts.
+type Config struct {
+	// Templates overrides chart titles, units, families, contexts, types and
+	// dimension names; nil keeps the defaults.
+	Templates *Templates
+
+	// TrafficUnit and LatencyUnit set the units of traffic and latency
+	// dimensions; zero values select DefaultTrafficUnit and
+	// DefaultLatencyUnit.
+	TrafficUnit Unit
+	LatencyUnit Unit
+
+	// Layout spaces chart priorities; zero steps select those of
+	// DefaultLayout.
+	Layout Layout
+}
+
+// Build returns the charts and values of in with the default Config.
+func Build(in sqm.Result) Plan {
+	return Config{}.Build(in)
+}
+
+// Build returns the charts and values of in.
+func (cfg Config) Build(in sqm.Result) Plan {
+	charts := make(map[string]*Chart)
+	updates := make(map[string]map[string]uint64)
+	chartData := make(map[string]TemplateData)
+	tpl := cfg.Templates
+	trafficUnit, latencyUnit := cfg.Units()
+	layout := cfg.Layout.orDefault()
+	offset := 0
+
+	variables := make(map[[2]string]float64)
+
+	// addVariable sets a chart-local variable, or a host variable for an
+	// empty chartID.
+	addVariable := func(chartID, name string, v float64) {
+		variables[[2]string{chartID, name}] = v
+	}
+
+	addUpdate := func(chartID, dimID string, v uint64) {
+		if _, ok := updates[chartID]; !ok {
+			updates[chartID] = make(map[string]uint64)
+		}
+		updates[chartID][dimID] = v
+	}
+
+	// ensureChart creates a chart of group, whose name is also its default
+	// context.
+	ensureChart := func(id, group string, data TemplateData, priority int, title, units, family string) *Chart {
+		if c, ok := charts[id]; ok {
+			return c
+		}
+		c := &Chart{
+			ID:       id,
+			Title:    tpl.render(group, "title", data, title),
+			Units:    tpl.render(group, "units", data, units),
+			Family:   tpl.render(group, "family", data, family),
+			Context:  tpl.render(group, "context", data, group),
+			Group:    group,
+			Type:     tpl.chartType(group, data.Interface, defaultChartType(group)),
+			Options:  tpl.chartOptions(group, data.Interface, []string{}),
+			Priority: priority,
+			Dims:     []Dimension{},
+		}
+		charts[id] = c
+		chartData[id] = data
+		return c
+	}
+
+	// ensureDim adds dimension prefix+id; prefix is the per-queue prefix of
+	// overlay charts and is prepended to the name in upper case.
+	ensureDim := func(c *Chart, prefix, id, name, algo string, mul, div int) {
+		for _, d := range c.Dims {
+			if d.ID == prefix+id {
+				return
+			}
+		}
+		name = tpl.render(c.Group, "dims."+id, chartData[c.ID], name)
+		c.Dims = append(c.Dims, Dimension{ID: prefix + id, Name: strings.ToUpper(prefix) + name, Algo: algo, Mul: mul, Div: div})
+	}
+
+	for _, rep := range in.Reports {
+		ifc := SanitizeKey(rep.Interface)
+		ifcData := TemplateData{Interface: rep.Interface, Mode: rep.Mode}
+
+		// Interface-level charts follow the tins, or all queue blocks in
+		// queue mode of a cake_mq root.
+		queueBlocks := rep.Mode == sqm.ModeQueue && rep.RootKind == "cake_mq"
+		ifcEnd := offset + layout.InterfaceStep
+		maxTins := 0
+		for _, q := range rep.Queues {
+			maxTins = max(maxTins, len(q.Tins))
+		}
+		ifcFirst := offset + 1 + maxTins*layout.TinStep
+		if queueBlocks {
+			ifcEnd = offset + layout.QueueInterfaceStep
+			ifcFirst = offset + len(rep.Queues)*layout.QueueStep
+		}
+		overviewID := fmt.Sprintf("SQM.%s_overview", ifc)
+		overview := ensureChart(overviewID, "overview", ifcData, offset, fmt.Sprintf("SQM qdisc %s Overview", rep.Interface), "mixed", fmt.Sprintf("%s Qdisc", rep.Interface))
+		ensureDim(overview, "", "bytes", "Bytes", "incremental", 1, 1)
+		ensureDim(overview, "", "backlog", "Backlog", "absolute", 1, 1)
+		ensureDim(overview, "", "drops", "Drops", "incremental", 1, 1)
+		ensureDim(overview, "", "packets", "Packets", "incremental", 1, 1)
+		ensureDim(overview, "", "overlimits", "Overlimits", "incremental", 1, 1)
+		ensureDim(overview, "", "requeues", "Requeues", "incremental", 1, 1)
+		ensureDim(overview, "", "qlen", "Qlen", "absolute", 1, 1)
+		addUpdate(overviewID, "bytes", rep.Overview.Bytes)
+		if rep.Bandwidth > 0 {
+			addVariable(overviewID, "bandwidth", float64(rep.Bandwidth))
+			addVariable("", "sqm_"+ifc+"_bandwidth", float64(rep.Bandwidth))
+		}
+		addUpdate(overviewID, "backlog", rep.Overview.Backlog)
+		addUpdate(overviewID, "drops", rep.Overview.Drops)
+		addUpdate(overviewID, "packets", rep.Overview.Packets)
+		addUpdate(overviewID, "overlimits", rep.Overview.Overlimits)
+		addUpdate(overviewID, "requeues", rep.Overview.Requeues)
+		addUpdate(overviewID, "qlen", rep.Overview.Qlen)
+
+		packetSizeID := fmt.Sprintf("SQM.%s_packet_size", ifc)
+		packetSize := ensureChart(packetSizeID, "qdisc_packet_size", ifcData, groupPriority(ifcFirst, ifcEnd, "qdisc_packet_size"), fmt.Sprintf("SQM qdisc %s Average Packet Size", rep.Interface), "bytes", fmt.Sprintf("%s Qdisc", rep.Interface))
+		ensureDim(packetSize, "", "all", "All", "absolute", 1, 1)
+		if r := rep.Overview.Rates; r != nil && r.Packets > 0 {
+			addUpdate(packetSizeID, "all", Scaled(r.AvgPacketSize, 1))
+		}
+
+		utilisationID := fmt.Sprintf("SQM.%s_utilisation", ifc)
+		linkUtil := ensureChart(utilisationID, "qdisc_utilisation", ifcData, groupPriority(ifcFirst, ifcEnd, "qdisc_utilisation"), fmt.Sprintf("SQM qdisc %s Utilisation", rep.Interface), "%", fmt.Sprintf("%s Qdisc", rep.Interface))
+		ensureDim(linkUtil, "", "util", "Util", "absolute", 1, 100)
+		if r := rep.Overview.Rates; r != nil && rep.Bandwidth > 0 {
+			addUpdate(utilisationID, "util", Scaled(r.Utilisation, 100))
+		}
+
+		bloatID := fmt.Sprintf("SQM.%s_bufferbloat", ifc)
+		bloat := ensureChart(bloatID, "qdisc_bufferbloat", ifcData, groupPriority(ifcFirst, ifcEnd, "qdisc_bufferbloat"), fmt.Sprintf("SQM qdisc %s Bufferbloat Grade", rep.Interface), "score", fmt.Sprintf("%s Qdisc", rep.Interface))
+		ensureDim(bloat, "", "score", "Score", "absolute", 1, 1)
+		bloatLatencyID := fmt.Sprintf("SQM.%s_bufferbloat_latency", ifc)
+		bloatLatency := ensureChart(bloatLatencyID, "qdisc_bufferbloat_latency", ifcData, groupPriority(ifcFirst, ifcEnd, "qdisc_bufferbloat_latency"), fmt.Sprintf("SQM qdisc %s Latency Under Load", rep.Interface), latencyUnit.Label, fmt.Sprintf("%s Qdisc", rep.Interface))
+		ensureDim(bloatLatency, "", "latency", "Latency Under Load", "absolute", latencyUnit.Mul, latencyUnit.Div)
+		if bb := rep.Bufferbloat; bb != nil && bb.Samples > 0 {
+			addUpdate(bloatID, "score", uint64(bb.Score))
+			addUpdate(bloatLatencyID, "latency", Scaled(bb.LatencyUS, 1))
+		}
+
+		adjustmentsID := fmt.Sprintf("SQM.%s_rate_adjustments", ifc)
+		adjustments := ensureChart(adjustmentsID, "qdisc_rate_adjustments", ifcData, groupPriority(ifcFirst, ifcEnd, "qdisc_rate_adjustments"), fmt.Sprintf("SQM qdisc %s Shaper Rate Adjustments", rep.Interface), "mixed", fmt.Sprintf("%s Qdisc", rep.Interface))
+		ensureDim(adjustments, "", "changes", "Adjustments", "incremental", 1, 1)
+		ensureDim(adjustments, "", "bandwidth", "Bandwidth "+trafficUnit.Label, "absolute", trafficUnit.Mul, trafficUnit.Div)
+		if ra := rep.RateAdjustments; ra != nil {
+			addUpdate(adjustmentsID, "changes", ra.Changes)
+			addUpdate(adjustmentsID, "bandwidth", ra.Bandwidth)
+		}
+
+		if im := rep.Imbalance; im != nil {
+			imbalanceID := fmt.Sprintf("SQM.%s_imbalance", ifc)
+			imbalance := ensureChart(imbalanceID, "qdisc_imbalance", ifcData, groupPriority(ifcFirst, ifcEnd, "qdisc_imbalance"), fmt.Sprintf("SQM qdisc %s Queue Imbalance", rep.Interface), "%", fmt.Sprintf("%s Qdisc", rep.Interface))
+			for _, ql := range im.Queues {
+				dimID := "q" + SanitizeKey(ql.QueueID) + "_share"
+				ensureDim(imbalance, "", dimID, "Q"+SanitizeKey(ql.QueueID)+" Share", "absolute", 1, 100)
+				addUpdate(imbalanceID, dimID, Scaled(ql.Share, 100))
+			}
+			ensureDim(imbalance, "", "cv", "Throughput CV", "absolute", 1, 100)
+			ensureDim(imbalance, "", "peak_skew", "Peak Max/Mean", "absolute", 1, 100)
+			addUpdate(imbalanceID, "cv", Scaled(im.ThroughputCV*100, 100))
+			addUpdate(imbalanceID, "peak_skew", Scaled(im.PeakMaxOverMean*100, 100))
+
+			busiestID := fmt.Sprintf("SQM.%s_busiest_queue", ifc)
+			busiest := ensureChart(busiestID, "qdisc_busiest_queue", ifcData, groupPriority(ifcFirst, ifcEnd, "qdisc_busiest_queue"), fmt.Sprintf("SQM qdisc %s Busiest Queue", rep.Interface), "queue", fmt.Sprintf("%s Qdisc", rep.Interface))
+			ensureDim(busiest, "", "busiest", "Busiest Queue", "absolute", 1, 1)
+			if n, ok := im.BusiestQueueNumber(); ok {
+				addUpdate(busiestID, "busiest", n)
+			}
+		}
+
+		for qn, q := range rep.Queues {
+			queueStart := offset
+			queueRatiosPriority := groupPriority(ifcFirst, ifcEnd, "qdisc_ratios")
+			if queueBlocks {
+				queueStart = offset + qn*layout.QueueStep
+				queueRatiosPriority = min(queueStart+1+len(q.Tins)*layout.TinStep, queueStart+layout.QueueStep-1)
+			}
+			qid := SanitizeKey(q.QueueID)
+			if qid == "" {
+				qid = "0"
+			}
+
+			queueData := ifcData
+			if rep.Mode == sqm.ModeQueue {
+				queueData.Queue = qid
+			}
+
+			if len(q.Tins) > 0 {
+				queueRatiosID := fmt.Sprintf("SQM.%s_ratios", ifc)
+				queueDimPrefix := ""
+				switch rep.Mode {
+				case sqm.ModeQueue:
+					queueRatiosID = fmt.Sprintf("SQM.%s_q%s_ratios", ifc, qid)
+				case sqm.ModeOverlay:
+					queueDimPrefix = "q" + qid + "_"
+				}
+				queueRatios := ensureChart(queueRatiosID, "qdisc_ratios", queueData, queueRatiosPriority, fmt.Sprintf("SQM qdisc %s Congestion Ratios", rep.Interface), "permille", fmt.Sprintf("%s Qdisc", rep.Interface))
+				ensureDim(queueRatios, queueDimPrefix, "drop", "Drop", "absolute", 1, 1000)
+				ensureDim(queueRatios, queueDimPrefix, "ecn", "Ecn", "absolute", 1, 1000)
+				ensureDim(queueRatios, queueDimPrefix, "ack", "Ack", "absolute", 1, 1000)
+				if r := q.Overview.Rates; r != nil {
+					addUpdate(queueRatiosID, queueDimPrefix+"drop", Scaled(r.DropRatio, 1000))
+					addUpdate(queueRatiosID, queueDimPrefix+"ecn", Scaled(r.ECNRatio, 1000))
+					addUpdate(queueRatiosID, queueDimPrefix+"ack", Scaled(r.AckRatio, 1000))
+				}
+			}
+
+			for ti, tin := range q.Tins {
+				tn := strings.ToUpper(SanitizeKey(tin.Tin))
+				if tn == "" {
+					tn = "T0"
+				}
+
+				tinData := queueData
+				tinData.Tin = tn
+
+				var chartPrefix string
+				switch rep.Mode {
+				case sqm.ModeQueue:
+					chartPrefix = fmt.Sprintf("SQM.%s_q%s_%s", ifc, qid, tn)
+				default:
+					chartPrefix = fmt.Sprintf("SQM.%s_%s", ifc, tn)
+				}
+
+				trafficID := chartPrefix + "_traffic"
+				latencyID := chartPrefix + "_latency"
+				dropsID := chartPrefix + "_drops"
+				backlogID := chartPrefix + "_backlog"
+				flowsID := chartPrefix + "_flows"
+				utilID := chartPrefix + "_utilisation"
+				ratiosID := chartPrefix + "_ratios"
+
+				traffic := ensureChart(trafficID, "traffic", tinData, layout.tinPriority(queueStart, ti, "traffic"), fmt.Sprintf("CAKE %s %s Traffic", rep.Interface, tn), trafficUnit.Label, fmt.Sprintf("%s %s", rep.Interface, tn))
+				latency := ensureChart(latencyID, "latency", tinData, layout.tinPriority(queueStart, ti, "latency"), fmt.Sprintf("CAKE %s %s Latency", rep.Interface, tn), latencyUnit.Label, fmt.Sprintf("%s %s", rep.Interface, tn))
+				drops := ensureChart(dropsID, "drops", tinData, layout.tinPriority(queueStart, ti, "drops"), fmt.Sprintf("CAKE %s %s Drops", rep.Interface, tn), "drops/s", fmt.Sprintf("%s %s", rep.Interface, tn))
+				backlog := ensureChart(backlogID, "backlog", tinData, layout.tinPriority(queueStart, ti, "backlog"), fmt.Sprintf("CAKE %s %s Backlog", rep.Interface, tn), "bytes", fmt.Sprintf("%s %s", rep.Interface, tn))
+				flows := ensureChart(flowsID, "flows", tinData, layout.tinPriority(queueStart, ti, "flows"), fmt.Sprintf("CAKE %s %s Flows", rep.Interface, tn), "flows", fmt.Sprintf("%s %s", rep.Interface, tn))
+				util := ensureChart(utilID, "utilisation", tinData, layout.tinPriority(queueStart, ti, "utilisation"), fmt.Sprintf("CAKE %s %s Utilisation", rep.Interface, tn), "%", fmt.Sprintf("%s %s", rep.Interface, tn))
+				ratios := ensureChart(ratiosID, "ratios", tinData, layout.tinPriority(queueStart, ti, "ratios"), fmt.Sprintf("CAKE %s %s Congestion Ratios", rep.Interface, tn), "permille", fmt.Sprintf("%s %s", rep.Interface, tn))
+
+				dimPrefix := ""
+				if rep.Mode == sqm.ModeOverlay {
+					dimPrefix = "q" + qid + "_"
+				}
+
+				ensureDim(traffic, dimPrefix, "bytes", "Bytes", "incremental", trafficUnit.Mul, trafficUnit.Div)
+				ensureDim(traffic, dimPrefix, "thres", "Thres", "absolute", trafficUnit.Mul, trafficUnit.Div)
+				ensureDim(traffic, dimPrefix, "pkts", "Packets", "incremental", 1, 1)
+				sizeDimPrefix := dimPrefix
+				if rep.Mode == sqm.ModeQueue {
+					sizeDimPrefix = "q" + qid + "_"
+				}
+				ensureDim(packetSize, sizeDimPrefix, strings.ToLower(tn), tn, "absolute", 1, 1)
+				ensureDim(latency, dimPrefix, "tg", "Target", "absolute", latencyUnit.Mul, latencyUnit.Div)
+				ensureDim(latency, dimPrefix, "pk", "Peak", "absolute", latencyUnit.Mul, latencyUnit.Div)
+				ensureDim(latency, dimPrefix, "av", "Avg", "absolute", latencyUnit.Mul, latencyUnit.Div)
+				ensureDim(latency, dimPrefix, "sp", "Sparse", "absolute", latencyUnit.Mul, latencyUnit.Div)
+				if tin.LatencyStats != nil {
+					ensureDim(latency, dimPrefix, "pk_win_min", "Peak Interval Min", "absolute", latencyUnit.Mul, latencyUnit.Div)
+					ensureDim(latency, dimPrefix, "pk_win_mean", "Peak Interval Mean", "absolute", latencyUnit.Mul, latencyUnit.Div)
+					ensureDim(latency, dimPrefix, "pk_win_max", "Peak Interval Max", "absolute", latencyUnit.Mul, latencyUnit.Div)
+					ensureDim(latency, dimPrefix, "pk_win_p95", "Peak Interval P95", "absolute", latencyUnit.Mul, latencyUnit.Div)
+					ensureDim(latency, dimPrefix, "av_win_min", "Avg Interval Min", "absolute", latencyUnit.Mul, latencyUnit.Div)
+					ensureDim(latency, dimPrefix, "av_win_mean", "Avg Interval Mean", "absolute", latencyUnit.Mul, latencyUnit.Div)
+					ensureDim(latency, dimPrefix, "av_win_max", "Avg Interval Max", "absolute", latencyUnit.Mul, latencyUnit.Div)
+					ensureDim(latency, dimPrefix, "av_win_p95", "Avg Interval P95", "absolute", latencyUnit.Mul, latencyUnit.Div)
+				}
+				if tin.Spread != nil {
+					ensureDim(latency, dimPrefix, "tg_min", "Target Min", "absolute", latencyUnit.Mul, latencyUnit.Div)
+					ensureDim(latency, dimPrefix, "tg_max", "Target Max", "absolute", latencyUnit.Mul, latencyUnit.Div)
+					ensureDim(latency, dimPrefix, "pk_min", "Peak Min", "absolute", latencyUnit.Mul, latencyUnit.Div)
+					ensureDim(latency, dimPrefix, "pk_max", "Peak Max", "absolute", latencyUnit.Mul, latencyUnit.Div)
+					ensureDim(latency, dimPrefix, "av_min", "Avg Min", "absolute", latencyUnit.Mul, latencyUnit.Div)
+					ensureDim(latency, dimPrefix, "av_max", "Avg Max", "absolute", latencyUnit.Mul, latencyUnit.Div)
+					ensureDim(latency, dimPrefix, "sp_min", "Sparse Min", "absolute", latencyUnit.Mul, latencyUnit.Div)
+					ensureDim(latency, dimPrefix, "sp_max", "Sparse Max", "absolute", latencyUnit.Mul, latencyUnit.Div)
+				}
+				ensureDim(drops, dimPrefix, "ack", "Ack", "incremental", 1, 1)
+				ensureDim(drops, dimPrefix, "drops", "Drops", "incremental", 1, 1)
+				ensureDim(drops, dimPrefix, "ecn", "Ecn", "incremental", 1, 1)
+				ensureDim(backlog, dimPrefix, "backlog", "Backlog", "absolute", 1, 1)
+				ensureDim(flows, dimPrefix, "sp", "Sparse", "absolute", 1, 1)
+				ensureDim(flows, dimPrefix, "bu", "Bulk", "absolute", 1, 1)
+				ensureDim(flows, dimPrefix, "un", "Unresponsive", "absolute", 1, 1)
+				ensureDim(util, dimPrefix, "util", "Util", "absolute", 1, 100)
+				ensureDim(ratios, dimPrefix, "drop", "Drop", "absolute", 1, 1000)
+				ensureDim(ratios, dimPrefix, "ecn", "Ecn", "absolute", 1, 1000)
+				ensureDim(ratios, dimPrefix, "ack", "Ack", "absolute", 1, 1000)
+
+				addUpdate(trafficID, dimPrefix+"bytes", tin.SentBytes)
+				addUpdate(trafficID, dimPrefix+"thres", tin.ThresholdRate)
+				hostVarPrefix := "sqm_" + strings.TrimPrefix(chartPrefix, "SQM.") + "_"
+				if rep.Mode == sqm.ModeOverlay {
+					hostVarPrefix += "q" + qid + "_"
+				}
+				addVariable(trafficID, dimPrefix+"threshold", trafficUnit.Scale(float64(tin.ThresholdRate)))
+				addVariable(latencyID, dimPrefix+"target", latencyUnit.Scale(float64(tin.TargetUS)))
+				addVariable("", hostVarPrefix+"threshold_rate", float64(tin.ThresholdRate))
+				addVariable("", hostVarPrefix+"target_us", float64(tin.TargetUS))
+				addUpdate(trafficID, dimPrefix+"pkts", tin.SentPackets)
+				if r := tin.Rates; r != nil && r.SentPackets > 0 {
+					addUpdate(packetSizeID, sizeDimPrefix+strings.ToLower(tn), Scaled(r.AvgPacketSize, 1))
+				}
+				addUpdate(latencyID, dimPrefix+"tg", tin.TargetUS)
+				addUpdate(latencyID, dimPrefix+"pk", tin.PeakDelayUS)
+				addUpdate(latencyID, dimPrefix+"av", tin.AvgDelayUS)
+				addUpdate(latencyID, dimPrefix+"sp", tin.BaseDelayUS)
+				if ls := tin.LatencyStats; ls != nil {
+					addUpdate(latencyID, dimPrefix+"pk_win_min", ls.Peak.MinUS)
+					addUpdate(latencyID, dimPrefix+"pk_win_mean", Scaled(ls.Peak.MeanUS, 1))
+					addUpdate(latencyID, dimPrefix+"pk_win_max", ls.Peak.MaxUS)
+					addUpdate(latencyID, dimPrefix+"pk_win_p95", ls.Peak.P95US)
+					addUpdate(latencyID, dimPrefix+"av_win_min", ls.Avg.MinUS)
+					addUpdate(latencyID, dimPrefix+"av_win_mean", Scaled(ls.Avg.MeanUS, 1))
+					addUpdate(latencyID, dimPrefix+"av_win_max", ls.Avg.MaxUS)
+					addUpdate(latencyID, dimPrefix+"av_win_p95", ls.Avg.P95US)
+				}
+				if sp := tin.Spread; sp != nil {
+					addUpdate(latencyID, dimPrefix+"tg_min", sp.TargetMinUS)
+					addUpdate(latencyID, dimPrefix+"tg_max", sp.TargetMaxUS)
+					addUpdate(latencyID, dimPrefix+"pk_min", sp.PeakMinUS)
+					addUpdate(latencyID, dimPrefix+"pk_max", sp.PeakMaxUS)
+					addUpdate(latencyID, dimPrefix+"av_min", sp.AvgMinUS)
+					addUpdate(latencyID, dimPrefix+"av_max", sp.AvgMaxUS)
+					addUpdate(latencyID, dimPrefix+"sp_min", sp.BaseMinUS)
+					addUpdate(latencyID, dimPrefix+"sp_max", sp.BaseMaxUS)
+				}
+				addUpdate(dropsID, dimPrefix+"ack", tin.AckDrops)
+				addUpdate(dropsID, dimPrefix+"drops", tin.Drops)
+				addUpdate(dropsID, dimPrefix+"ecn", tin.ECNMark)
+				addUpdate(backlogID, dimPrefix+"backlog", tin.BacklogBytes)
+				addUpdate(flowsID, dimPrefix+"sp", tin.SparseFlows)
+				addUpdate(flowsID, dimPrefix+"bu", tin.BulkFlows)
+				addUpdate(flowsID, dimPrefix+"un", tin.UnresponsiveFlows)
+				if r := tin.Rates; r != nil {
+					if tin.ThresholdRate > 0 {
+						addUpdate(utilID, dimPrefix+"util", Scaled(r.Utilisation, 100))
+					}
+					addUpdate(ratiosID, dimPrefix+"drop", Scaled(r.DropRatio, 1000))
+					addUpdate(ratiosID, dimPrefix+"ecn", Scaled(r.ECNRatio, 1000))
+					addUpdate(ratiosID, dimPrefix+"ack", Scaled(r.AckRatio, 1000))
+				}
+			}
+		}
+		offset = ifcEnd
+	}
+
+	keys := make([]string, 0, len(charts))
+	for k := range charts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := charts[keys[i]], charts[keys[j]]
+		if a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+		return a.ID < b.ID
+	})
+	outCharts := make([]Chart, 0, len(keys))
+	for _, k := range keys {
+		c := charts[k]
+		sort.Slice(c.Dims, func(i, j int) bool { return c.Dims[i].ID < c.Dims[j].ID })
+		outCharts = append(outCharts, *c)
+	}
+
+	outVars := make([]Variable, 0, len(variables))
+	for k, v := range variables {
+		outVars = append(outVars, Variable{Chart: k[0], Name: k[1], Value: v})
+	}
+	sort.Slice(outVars, func(i, j int) bool {
+		if outVars[i].Chart != outVars[j].Chart {
+			return outVars[i].Chart < outVars[j].Chart
+		}
+		return outVars[i].Name < outVars[j].Name
+	})
+
+	return Plan{Charts: outCharts, Updates: updates, Variables: outVars}
+}
+
+// defaultChartType returns the chart type of group without templates: area
+// for traffic, stacked for flows and line otherwise.
+func defaultChartType(group string) string {
+	if t, ok := defaultChartTypes[group]; ok {
+		return t
+	}
+	return "line"
+}
+
+// Scaled converts a derived value to the fixed-point integer Netdata expects
+// for a dimension with the given divisor.
+func Scaled(v float64, div int) uint64 {
+	if v <= 0 {
+		return 0
+	}
+	return uint64(math.Round(v * float64(div)))
+}
+
+// SanitizeKey reduces v to the characters allowed in chart, dimension and metric
+// IDs, collapsing everything else to single underscores.
+func SanitizeKey(v string) string {
+	if v == "" {
+		return ""
+	}
+	var b strings.Builder
+	for _, r := range v {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r >= 'a' && r <= 'z':
+			b.WriteRune(r)
+		case r >= 'A' && r <= 'Z':
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	out := strings.Trim(b.String(), "_")
+	for strings.Contains(out, "__") {
+		out = strings.ReplaceAll(out, "__", "_")
+	}
+	return out
+}
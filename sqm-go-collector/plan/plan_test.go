@@ -0,0 +1,512 @@
+package plan
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/sqm"
+)
+
+func TestBuildOverlayDimensions(t *testing.T) {
+	in := sqm.Result{
+		Reports: []sqm.InterfaceReport{
+			{
+				Interface: "eth0",
+				Mode:      sqm.ModeOverlay,
+				Overview:  sqm.Overview{Bytes: 1000, Drops: 1, Backlog: 0},
+				Queues: []sqm.QueueReport{
+					{
+						QueueID: "1",
+						Tins: []sqm.TinMetrics{
+							{
+								Tin:           "BE",
+								ThresholdRate: 125000000,
+								SentBytes:     200000,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	p := Build(in)
+	var foundChart *Chart
+	for i := range p.Charts {
+		if p.Charts[i].ID == "SQM.eth0_BE_traffic" {
+			foundChart = &p.Charts[i]
+			break
+		}
+	}
+	if foundChart == nil {
+		t.Fatalf("missing chart SQM.eth0_BE_traffic")
+	}
+
+	var q1Bytes, q1Thres *Dimension
+	for i := range foundChart.Dims {
+		switch foundChart.Dims[i].ID {
+		case "q1_bytes":
+			q1Bytes = &foundChart.Dims[i]
+		case "q1_thres":
+			q1Thres = &foundChart.Dims[i]
+		}
+	}
+	if q1Bytes == nil || q1Thres == nil {
+		t.Fatalf("missing expected overlay dimensions in traffic chart")
+	}
+	if q1Bytes.Algo != "incremental" || q1Bytes.Mul != 1 || q1Bytes.Div != 125 {
+		t.Fatalf("unexpected q1_bytes dim config: %+v", *q1Bytes)
+	}
+	if q1Thres.Algo != "absolute" || q1Thres.Mul != 1 || q1Thres.Div != 125 {
+		t.Fatalf("unexpected q1_thres dim config: %+v", *q1Thres)
+	}
+}
+
+func TestUtilisationUpdates(t *testing.T) {
+	in := sqm.Result{Reports: []sqm.InterfaceReport{{
+		Interface: "eth0",
+		Mode:      sqm.ModeCakeMQ,
+		Bandwidth: 1000,
+		Overview:  sqm.Overview{Rates: &sqm.OverviewRates{Bytes: 250}},
+		Queues: []sqm.QueueReport{{
+			QueueID: "all",
+			Tins:    []sqm.TinMetrics{{Tin: "BE", ThresholdRate: 400, Rates: &sqm.TinRates{SentBytes: 100}}},
+		}},
+	}}}
+	sqm.DeriveMetrics(&in)
+
+	p := Build(in)
+	if got := p.Updates["SQM.eth0_utilisation"]["util"]; got != 2500 {
+		t.Fatalf("link utilisation = %d, want 2500 (25.00%%)", got)
+	}
+	if got := p.Updates["SQM.eth0_BE_utilisation"]["util"]; got != 2500 {
+		t.Fatalf("tin utilisation = %d, want 2500 (25.00%%)", got)
+	}
+}
+
+func TestCongestionRatioUpdates(t *testing.T) {
+	in := sqm.Result{Reports: []sqm.InterfaceReport{{
+		Interface: "eth0",
+		Mode:      sqm.ModeOverlay,
+		Overview:  sqm.Overview{Rates: &sqm.OverviewRates{}},
+		Queues: []sqm.QueueReport{{
+			QueueID:  "1",
+			Overview: sqm.Overview{Rates: &sqm.OverviewRates{}},
+			Tins: []sqm.TinMetrics{
+				{Tin: "BE", Rates: &sqm.TinRates{SentPackets: 990, Drops: 10, ECNMark: 99}},
+				{Tin: "VI", Rates: &sqm.TinRates{SentPackets: 1000}},
+			},
+		}},
+	}}}
+	sqm.DeriveMetrics(&in)
+
+	p := Build(in)
+	if got := p.Updates["SQM.eth0_BE_ratios"]["q1_drop"]; got != 10000 {
+		t.Fatalf("tin drop ratio update = %d, want 10000", got)
+	}
+	if got := p.Updates["SQM.eth0_ratios"]["q1_drop"]; got != 5000 {
+		t.Fatalf("queue drop ratio update = %d, want 5000", got)
+	}
+}
+
+func TestImbalanceUpdates(t *testing.T) {
+	im := &sqm.QueueImbalance{
+		Queues:       []sqm.QueueLoad{{QueueID: "1", Share: 25}, {QueueID: "2", Share: 75}},
+		BusiestQueue: "2",
+	}
+	p := Build(sqm.Result{Reports: []sqm.InterfaceReport{{Interface: "eth0", Mode: sqm.ModeCakeMQ, Imbalance: im}}})
+	if got := p.Updates["SQM.eth0_imbalance"]["q2_share"]; got != 7500 {
+		t.Fatalf("q2 share update = %d, want 7500", got)
+	}
+	if got := p.Updates["SQM.eth0_busiest_queue"]["busiest"]; got != 2 {
+		t.Fatalf("busiest update = %d, want 2", got)
+	}
+	for _, c := range p.Charts {
+		if c.ID == "SQM.eth0_imbalance" && slices.ContainsFunc(c.Dims, func(d Dimension) bool { return d.ID == "busiest" }) {
+			t.Fatalf("busiest queue must not share the %% imbalance chart: %+v", c)
+		}
+		if c.ID == "SQM.eth0_busiest_queue" && c.Units != "queue" {
+			t.Fatalf("busiest queue units = %s, want queue", c.Units)
+		}
+	}
+}
+
+func TestBufferbloatUpdates(t *testing.T) {
+	bb := &sqm.Bufferbloat{Grade: "B", Score: 3, LatencyUS: 40000, Samples: 1}
+	p := Build(sqm.Result{Reports: []sqm.InterfaceReport{{Interface: "eth0", Bufferbloat: bb}}})
+	if got := p.Updates["SQM.eth0_bufferbloat"]["score"]; got != 3 {
+		t.Fatalf("score update = %d, want 3", got)
+	}
+	if got := p.Updates["SQM.eth0_bufferbloat_latency"]["latency"]; got != 40000 {
+		t.Fatalf("latency update = %d, want 40000", got)
+	}
+	for _, c := range p.Charts {
+		if c.ID == "SQM.eth0_bufferbloat" && (c.Units != "score" || len(c.Dims) != 1) {
+			t.Fatalf("bufferbloat score chart must only hold the score: %+v", c)
+		}
+		if c.ID == "SQM.eth0_bufferbloat_latency" && c.Units != "ms" {
+			t.Fatalf("bufferbloat latency units = %s, want ms", c.Units)
+		}
+	}
+}
+
+func TestPacketUpdates(t *testing.T) {
+	in := sqm.Result{Reports: []sqm.InterfaceReport{{
+		Interface: "eth0",
+		Mode:      sqm.ModeCakeMQ,
+		Overview:  sqm.Overview{Packets: 40, Rates: &sqm.OverviewRates{Bytes: 15000, Packets: 10}},
+		Queues: []sqm.QueueReport{{
+			QueueID: "all",
+			Tins:    []sqm.TinMetrics{{Tin: "BE", SentPackets: 30, Rates: &sqm.TinRates{SentBytes: 600, SentPackets: 10}}},
+		}},
+	}}}
+	sqm.DeriveMetrics(&in)
+
+	p := Build(in)
+	if got := p.Updates["SQM.eth0_overview"]["packets"]; got != 40 {
+		t.Fatalf("overview packets = %d, want 40", got)
+	}
+	if got := p.Updates["SQM.eth0_BE_traffic"]["pkts"]; got != 30 {
+		t.Fatalf("tin packets = %d, want 30", got)
+	}
+	if got := p.Updates["SQM.eth0_packet_size"]["all"]; got != 1500 {
+		t.Fatalf("overview packet size = %d, want 1500", got)
+	}
+	if got := p.Updates["SQM.eth0_packet_size"]["be"]; got != 60 {
+		t.Fatalf("tin packet size = %d, want 60", got)
+	}
+}
+
+func TestOverviewThrottlingDimensions(t *testing.T) {
+	in := sqm.Result{Reports: []sqm.InterfaceReport{{
+		Interface: "eth0",
+		Overview:  sqm.Overview{Overlimits: 7, Requeues: 3, Qlen: 4},
+	}}}
+	p := Build(in)
+	want := map[string]string{"backlog": "absolute", "overlimits": "incremental", "requeues": "incremental", "qlen": "absolute"}
+	for _, c := range p.Charts {
+		if c.ID != "SQM.eth0_overview" {
+			continue
+		}
+		for _, d := range c.Dims {
+			if algo, ok := want[d.ID]; ok {
+				if d.Algo != algo {
+					t.Fatalf("dimension %s algo = %s, want %s", d.ID, d.Algo, algo)
+				}
+				delete(want, d.ID)
+			}
+		}
+	}
+	if len(want) != 0 {
+		t.Fatalf("missing overview dimensions: %v", want)
+	}
+}
+
+func TestTemplatesOverride(t *testing.T) {
+	tpl, err := ParseTemplates([]byte(`{
+  "groups": {
+    "traffic": {"title": "{{.Interface}} {{.Tin}} Verkehr", "type": "area", "dims": {"bytes": "Gesendet"}},
+    "overview": {"family": "{{.Default}} (WAN)", "context": "sqm_overview"}
+  },
+  "interfaces": {
+    "eth1": {"traffic": {"title": "Downlink {{.Tin}}"}}
+  }
+}`))
+	if err != nil {
+		t.Fatalf("ParseTemplates: %v", err)
+	}
+
+	tin := []sqm.TinMetrics{{Tin: "BE"}}
+	in := sqm.Result{Reports: []sqm.InterfaceReport{
+		{Interface: "eth0", Mode: sqm.ModeOverlay, Queues: []sqm.QueueReport{{QueueID: "1", Tins: tin}}},
+		{Interface: "eth1", Mode: sqm.ModeCakeMQ, Queues: []sqm.QueueReport{{QueueID: "all", Tins: tin}}},
+	}}
+	p := Config{Templates: tpl}.Build(in)
+	charts := make(map[string]Chart)
+	for _, c := range p.Charts {
+		charts[c.ID] = c
+	}
+
+	eth0 := charts["SQM.eth0_BE_traffic"]
+	if eth0.Title != "eth0 BE Verkehr" || eth0.Type != "area" || eth0.Units != "Kb/s" {
+		t.Fatalf("unexpected eth0 traffic chart: %+v", eth0)
+	}
+	names := make(map[string]string)
+	for _, d := range eth0.Dims {
+		names[d.ID] = d.Name
+	}
+	if names["q1_bytes"] != "Q1_Gesendet" || names["q1_thres"] != "Q1_Thres" {
+		t.Fatalf("unexpected dimension names: %v", names)
+	}
+	if got := charts["SQM.eth1_BE_traffic"].Title; got != "Downlink BE" {
+		t.Fatalf("interface override title = %q", got)
+	}
+	if ov := charts["SQM.eth0_overview"]; ov.Family != "eth0 Qdisc (WAN)" || ov.Context != "sqm_overview" || ov.Type != "line" {
+		t.Fatalf("unexpected overview chart: %+v", ov)
+	}
+	if got := Build(in); got.Charts[0].Title == "" || got.Charts[0].Type != "line" {
+		t.Fatalf("default build lost titles or type: %+v", got.Charts[0])
+	}
+}
+
+func TestParseTemplatesErrors(t *testing.T) {
+	for _, in := range []string{
+		`{"groups": {"trafic": {"title": "x"}}}`,
+		`{"groups": {"traffic": {"type": "pie"}}}`,
+		`{"groups": {"traffic": {"title": "{{.Nope}}"}}}`,
+		`{"interfaces": {"eth0": {"latency": {"dims": {"pk": "{{"}}}}}}`,
+		`{"group": {}}`,
+	} {
+		if _, err := ParseTemplates([]byte(in)); err == nil {
+			t.Fatalf("ParseTemplates(%s): expected error", in)
+		}
+	}
+}
+
+func TestUnits(t *testing.T) {
+	traffic, err := ParseTrafficUnit("Mbit")
+	if err != nil {
+		t.Fatalf("ParseTrafficUnit: %v", err)
+	}
+	latency, err := ParseLatencyUnit("us")
+	if err != nil {
+		t.Fatalf("ParseLatencyUnit: %v", err)
+	}
+	if _, err := ParseTrafficUnit("mbps"); err == nil {
+		t.Fatalf("expected error for unknown traffic unit")
+	}
+
+	in := sqm.Result{Reports: []sqm.InterfaceReport{{
+		Interface: "eth0",
+		Mode:      sqm.ModeCakeMQ,
+		Queues:    []sqm.QueueReport{{QueueID: "all", Tins: []sqm.TinMetrics{{Tin: "BE"}}}},
+	}}}
+	p := Config{TrafficUnit: traffic, LatencyUnit: latency}.Build(in)
+	dims := make(map[string]Dimension)
+	units := make(map[string]string)
+	for _, c := range p.Charts {
+		units[c.ID] = c.Units
+		for _, d := range c.Dims {
+			dims[c.ID+"/"+d.ID] = d
+		}
+	}
+	if units["SQM.eth0_BE_traffic"] != "Mb/s" || units["SQM.eth0_BE_latency"] != "µs" {
+		t.Fatalf("unexpected units: %v", units)
+	}
+	if d := dims["SQM.eth0_BE_traffic/bytes"]; d.Mul != 1 || d.Div != 125000 {
+		t.Fatalf("unexpected bytes dim: %+v", d)
+	}
+	if d := dims["SQM.eth0_rate_adjustments/bandwidth"]; d.Name != "Bandwidth Mb/s" || d.Div != 125000 {
+		t.Fatalf("unexpected bandwidth dim: %+v", d)
+	}
+	if d := dims["SQM.eth0_BE_latency/pk"]; d.Div != 1 {
+		t.Fatalf("unexpected peak dim: %+v", d)
+	}
+	if d := dims["SQM.eth0_bufferbloat_latency/latency"]; d.Div != 1 || units["SQM.eth0_bufferbloat_latency"] != "µs" {
+		t.Fatalf("unexpected bufferbloat latency dim: %+v", d)
+	}
+	if d := dims["SQM.eth0_BE_ratios/drop"]; d.Div != 1000 {
+		t.Fatalf("ratio dims must not follow latency units: %+v", d)
+	}
+}
+
+func TestLayoutMatchesShell(t *testing.T) {
+	tins := []sqm.TinMetrics{{Tin: "BK"}, {Tin: "BE"}}
+	in := sqm.Result{Reports: []sqm.InterfaceReport{
+		{Interface: "eth0", Mode: sqm.ModeOverlay, RootKind: "cake_mq", Queues: []sqm.QueueReport{{QueueID: "1", Tins: tins}, {QueueID: "2", Tins: tins}}},
+		{Interface: "eth1", Mode: sqm.ModeQueue, RootKind: "cake_mq", Queues: []sqm.QueueReport{{QueueID: "1", Tins: tins[:1]}, {QueueID: "2", Tins: tins[:1]}}},
+		{Interface: "eth2", Mode: sqm.ModeQueue, RootKind: "cake", Queues: []sqm.QueueReport{{QueueID: "root", Tins: tins}}},
+	}}
+	p := Build(in)
+	got := make(map[string]int)
+	for i, c := range p.Charts {
+		got[c.ID] = c.Priority
+		if i > 0 && c.Priority < p.Charts[i-1].Priority {
+			t.Fatalf("charts not sorted by priority at %s", c.ID)
+		}
+	}
+	want := map[string]int{
+		"SQM.eth0_overview":            0,
+		"SQM.eth0_BK_traffic":          1,
+		"SQM.eth0_BK_latency":          2,
+		"SQM.eth0_BK_flows":            5,
+		"SQM.eth0_BK_utilisation":      5,
+		"SQM.eth0_BE_traffic":          6,
+		"SQM.eth0_BE_flows":            10,
+		"SQM.eth0_utilisation":         11,
+		"SQM.eth0_ratios":              13,
+		"SQM.eth0_bufferbloat":         15,
+		"SQM.eth0_bufferbloat_latency": 17,
+		"SQM.eth1_overview":            50,
+		"SQM.eth1_q1_BK_traffic":       51,
+		"SQM.eth1_q1_ratios":           56,
+		"SQM.eth1_q2_BK_traffic":       101,
+		"SQM.eth1_utilisation":         150,
+		"SQM.eth1_rate_adjustments":    155,
+		"SQM.eth2_overview":            550,
+		"SQM.eth2_qroot_BE_traffic":    556,
+	}
+	for id, prio := range want {
+		if got[id] != prio {
+			t.Fatalf("%s priority = %d, want %d", id, got[id], prio)
+		}
+	}
+
+	l, err := ParseLayout("tin=7, interface=100")
+	if err != nil || l.TinStep != 7 || l.InterfaceStep != 100 || l.QueueStep != 50 {
+		t.Fatalf("ParseLayout = %+v, %v", l, err)
+	}
+	if got := (Config{Layout: l}).Build(in); got.Charts[len(got.Charts)-1].Priority < 600 {
+		t.Fatalf("custom layout not applied: %+v", got.Charts[len(got.Charts)-1])
+	}
+	for _, bad := range []string{"tin", "tin=0", "lane=5"} {
+		if _, err := ParseLayout(bad); err == nil {
+			t.Fatalf("ParseLayout(%q): expected error", bad)
+		}
+	}
+}
+
+func TestChartTypesAndOptions(t *testing.T) {
+	tpl, err := ParseTemplates([]byte(`{
+  "groups": {"latency": {"options": ["detail", "store_first"]}, "flows": {"type": "line"}},
+  "interfaces": {"eth1": {"latency": {"options": []}}}
+}`))
+	if err != nil {
+		t.Fatalf("ParseTemplates: %v", err)
+	}
+	if _, err := ParseTemplates([]byte(`{"groups": {"latency": {"options": ["sticky"]}}}`)); err == nil {
+		t.Fatalf("expected error for unknown chart option")
+	}
+
+	tins := []sqm.TinMetrics{{Tin: "BE"}}
+	in := sqm.Result{Reports: []sqm.InterfaceReport{
+		{Interface: "eth0", Mode: sqm.ModeCakeMQ, Queues: []sqm.QueueReport{{QueueID: "all", Tins: tins}}},
+		{Interface: "eth1", Mode: sqm.ModeCakeMQ, Queues: []sqm.QueueReport{{QueueID: "all", Tins: tins}}},
+	}}
+	charts := make(map[string]Chart)
+	for _, c := range Build(in).Charts {
+		charts[c.ID] = c
+	}
+	for id, want := range map[string]string{"SQM.eth0_BE_traffic": "area", "SQM.eth0_BE_flows": "stacked", "SQM.eth0_BE_latency": "line"} {
+		if c := charts[id]; c.Type != want || len(c.Options) != 0 {
+			t.Fatalf("%s: type %q options %v, want %q and no options", id, c.Type, c.Options, want)
+		}
+	}
+
+	for _, c := range (Config{Templates: tpl}).Build(in).Charts {
+		charts[c.ID] = c
+	}
+	if c := charts["SQM.eth0_BE_latency"]; strings.Join(c.Options, " ") != "detail store_first" {
+		t.Fatalf("eth0 latency options = %v", c.Options)
+	}
+	if c := charts["SQM.eth1_BE_latency"]; len(c.Options) != 0 {
+		t.Fatalf("eth1 latency options not cleared: %v", c.Options)
+	}
+	if c := charts["SQM.eth0_BE_flows"]; c.Type != "line" {
+		t.Fatalf("flows type override = %q", c.Type)
+	}
+}
+
+func TestVariables(t *testing.T) {
+	tins := []sqm.TinMetrics{{Tin: "BE", ThresholdRate: 125000, TargetUS: 5000}}
+	in := sqm.Result{Reports: []sqm.InterfaceReport{
+		{Interface: "eth0", Mode: sqm.ModeCakeMQ, Bandwidth: 250000, Queues: []sqm.QueueReport{{QueueID: "all", Tins: tins}}},
+		{Interface: "eth1", Mode: sqm.ModeOverlay, Queues: []sqm.QueueReport{{QueueID: "1", Tins: tins}}},
+	}}
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+		want map[string]float64
+	}{
+		{"default units", Config{}, map[string]float64{
+			"/sqm_eth0_bandwidth":              250000,
+			"/sqm_eth0_BE_threshold_rate":      125000,
+			"/sqm_eth0_BE_target_us":           5000,
+			"/sqm_eth1_BE_q1_threshold_rate":   125000,
+			"SQM.eth0_overview/bandwidth":      250000,
+			"SQM.eth0_BE_traffic/threshold":    1000,
+			"SQM.eth0_BE_latency/target":       5,
+			"SQM.eth1_BE_traffic/q1_threshold": 1000,
+			"SQM.eth1_BE_latency/q1_target":    5,
+		}},
+		{"mbit and us", Config{TrafficUnit: TrafficUnits["mbit"], LatencyUnit: LatencyUnits["us"]}, map[string]float64{
+			"/sqm_eth0_BE_threshold_rate":   125000,
+			"/sqm_eth0_BE_target_us":        5000,
+			"SQM.eth0_BE_traffic/threshold": 1,
+			"SQM.eth0_BE_latency/target":    5000,
+		}},
+		{"bit", Config{TrafficUnit: TrafficUnits["bit"]}, map[string]float64{
+			"SQM.eth0_BE_traffic/threshold": 1000000,
+		}},
+	} {
+		got := make(map[string]float64)
+		for _, v := range tc.cfg.Build(in).Variables {
+			got[v.Chart+"/"+v.Name] = v.Value
+		}
+		for k, v := range tc.want {
+			if got[k] != v {
+				t.Fatalf("%s: variable %s = %v, want %v (all: %v)", tc.name, k, got[k], v, got)
+			}
+		}
+		if _, ok := got["/sqm_eth1_bandwidth"]; ok {
+			t.Fatalf("unshaped interface must not get a bandwidth variable")
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	overlay := func(tins []string, queues ...string) sqm.Result {
+		rep := sqm.InterfaceReport{Interface: "eth0", Mode: sqm.ModeOverlay, RootKind: "cake_mq"}
+		for _, q := range queues {
+			qr := sqm.QueueReport{QueueID: q}
+			for _, tin := range tins {
+				qr.Tins = append(qr.Tins, sqm.TinMetrics{Tin: tin})
+			}
+			rep.Queues = append(rep.Queues, qr)
+		}
+		return sqm.Result{Reports: []sqm.InterfaceReport{rep}}
+	}
+	first := Build(overlay([]string{"BE"}, "1"))
+
+	if got := Diff(Plan{}, first); len(got) != len(first.Charts) || len(got[0].Dims) != len(first.Charts[0].Dims) {
+		t.Fatalf("diff from an empty plan should define every chart: %d changes for %d charts", len(got), len(first.Charts))
+	}
+	if got := Diff(first, first); len(got) != 0 {
+		t.Fatalf("unchanged plan should have no changes: %+v", got)
+	}
+
+	second := Build(overlay([]string{"BE", "VI"}, "2"))
+	changes := make(map[string]ChartChange)
+	for _, ch := range Diff(first, second) {
+		changes[ch.Chart.ID] = ch
+	}
+	if ch, ok := changes["SQM.eth0_VI_traffic"]; !ok || ch.Obsolete || len(ch.Dims) == 0 {
+		t.Fatalf("expected new VI traffic chart: %+v", ch)
+	}
+	be, ok := changes["SQM.eth0_BE_traffic"]
+	if !ok || be.Obsolete || len(be.Dims) == 0 || len(be.ObsoleteDims) == 0 {
+		t.Fatalf("expected BE traffic dimension changes: %+v", be)
+	}
+	for _, d := range be.Dims {
+		if !strings.HasPrefix(d.ID, "q2_") {
+			t.Fatalf("unexpected new dimension %q", d.ID)
+		}
+	}
+	for _, d := range be.ObsoleteDims {
+		if !strings.HasPrefix(d.ID, "q1_") {
+			t.Fatalf("unexpected obsolete dimension %q", d.ID)
+		}
+	}
+
+	third := Build(overlay([]string{"VI"}, "2"))
+	var obsolete []string
+	for _, ch := range Diff(second, third) {
+		if ch.Obsolete {
+			obsolete = append(obsolete, ch.Chart.ID)
+		}
+	}
+	if len(obsolete) == 0 || !strings.Contains(strings.Join(obsolete, ","), "SQM.eth0_BE_traffic") {
+		t.Fatalf("expected obsolete BE charts, got %v", obsolete)
+	}
+}
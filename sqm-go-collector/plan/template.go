@@ -0,0 +1,212 @@
+package plan
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Groups lists the metric groups charts belong to. A group name is also the
+// default context of its charts.
+var Groups = []string{
+	"overview",
+	"qdisc_packet_size",
+	"qdisc_utilisation",
+	"qdisc_bufferbloat",
+	"qdisc_bufferbloat_latency",
+	"qdisc_rate_adjustments",
+	"qdisc_imbalance",
+	"qdisc_busiest_queue",
+	"qdisc_ratios",
+	"traffic",
+	"latency",
+	"drops",
+	"backlog",
+	"flows",
+	"utilisation",
+	"ratios",
+}
+
+// ChartTypes lists the Netdata chart types a template may select.
+var ChartTypes = []string{"line", "area", "stacked"}
+
+// ChartOptions lists the Netdata chart options a template may set.
+var ChartOptions = []string{"detail", "hidden", "obsolete", "store_first"}
+
+// defaultChartTypes holds the chart type of groups not drawn as lines.
+var defaultChartTypes = map[string]string{
+	"traffic": "area",
+	"flows":   "stacked",
+}
+
+// GroupTemplate overrides the presentation of the charts of one metric group.
+// Title, Units, Family, Context and the Dims values are text/template strings
+// executed with TemplateData; empty fields keep the defaults. Dims is keyed by
+// dimension ID without the per-queue prefix of overlay charts (e.g. "bytes",
+// "pk_win_p95"), and that prefix is prepended to the rendered name. Type and
+// Options are used as given; a non-nil Options replaces the default options,
+// so an empty list clears them.
+type GroupTemplate struct {
+	Title   string            `json:"title,omitempty"`
+	Units   string            `json:"units,omitempty"`
+	Family  string            `json:"family,omitempty"`
+	Context string            `json:"context,omitempty"`
+	Type    string            `json:"type,omitempty"`
+	Options []string          `json:"options,omitempty"`
+	Dims    map[string]string `json:"dims,omitempty"`
+}
+
+// TemplateData is the data a template is executed with. Queue is set on
+// per-queue charts of queue mode only and Tin on per-tin charts. Default is the
+// value the field would have without the template.
+type TemplateData struct {
+	Interface string
+	Mode      string
+	Queue     string
+	Tin       string
+	Default   string
+}
+
+// Templates holds per-group overrides and per-interface overrides on top of
+// them. Use ParseTemplates or LoadTemplates to obtain a usable value.
+type Templates struct {
+	Groups     map[string]GroupTemplate            `json:"groups,omitempty"`
+	Interfaces map[string]map[string]GroupTemplate `json:"interfaces,omitempty"`
+
+	parsed map[string]*template.Template
+}
+
+// LoadTemplates reads and parses a JSON templates file.
+func LoadTemplates(path string) (*Templates, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := ParseTemplates(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
+
+// ParseTemplates parses JSON templates, rejecting unknown groups, chart types
+// and options and templates that do not execute.
+func ParseTemplates(b []byte) (*Templates, error) {
+	t := &Templates{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(t); err != nil {
+		return nil, err
+	}
+	t.parsed = make(map[string]*template.Template)
+
+	if err := t.parseGroups("groups", t.Groups); err != nil {
+		return nil, err
+	}
+	ifcs := make([]string, 0, len(t.Interfaces))
+	for ifc := range t.Interfaces {
+		ifcs = append(ifcs, ifc)
+	}
+	sort.Strings(ifcs)
+	for _, ifc := range ifcs {
+		if err := t.parseGroups("interfaces."+ifc, t.Interfaces[ifc]); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *Templates) parseGroups(scope string, groups map[string]GroupTemplate) error {
+	names := make([]string, 0, len(groups))
+	for group := range groups {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+	for _, group := range names {
+		if !slices.Contains(Groups, group) {
+			return fmt.Errorf("%s: unknown group %q (expected %s)", scope, group, strings.Join(Groups, "|"))
+		}
+		g := groups[group]
+		if g.Type != "" && !slices.Contains(ChartTypes, g.Type) {
+			return fmt.Errorf("%s.%s: invalid type %q (expected %s)", scope, group, g.Type, strings.Join(ChartTypes, "|"))
+		}
+		for _, opt := range g.Options {
+			if !slices.Contains(ChartOptions, opt) {
+				return fmt.Errorf("%s.%s: invalid option %q (expected %s)", scope, group, opt, strings.Join(ChartOptions, "|"))
+			}
+		}
+		fields := map[string]string{"title": g.Title, "units": g.Units, "family": g.Family, "context": g.Context}
+		for dim, v := range g.Dims {
+			fields["dims."+dim] = v
+		}
+		for field, v := range fields {
+			if v == "" {
+				continue
+			}
+			name := scope + "." + group + "." + field
+			tpl, err := template.New(name).Option("missingkey=error").Parse(v)
+			if err != nil {
+				return err
+			}
+			if err := tpl.Execute(&bytes.Buffer{}, TemplateData{}); err != nil {
+				return err
+			}
+			t.parsed[name] = tpl
+		}
+	}
+	return nil
+}
+
+// render executes the template of field for group, preferring the interface
+// override. It returns def when no template applies or execution fails.
+func (t *Templates) render(group, field string, data TemplateData, def string) string {
+	if t == nil {
+		return def
+	}
+	tpl := t.parsed["interfaces."+data.Interface+"."+group+"."+field]
+	if tpl == nil {
+		tpl = t.parsed["groups."+group+"."+field]
+	}
+	if tpl == nil {
+		return def
+	}
+	data.Default = def
+	var b strings.Builder
+	if err := tpl.Execute(&b, data); err != nil {
+		return def
+	}
+	return b.String()
+}
+
+// chartType returns the chart type of group for ifc, or def.
+func (t *Templates) chartType(group, ifc, def string) string {
+	if t == nil {
+		return def
+	}
+	if g, ok := t.Interfaces[ifc][group]; ok && g.Type != "" {
+		return g.Type
+	}
+	if g, ok := t.Groups[group]; ok && g.Type != "" {
+		return g.Type
+	}
+	return def
+}
+
+// chartOptions returns the chart options of group for ifc, or def.
+func (t *Templates) chartOptions(group, ifc string, def []string) []string {
+	if t == nil {
+		return def
+	}
+	if g, ok := t.Interfaces[ifc][group]; ok && g.Options != nil {
+		return g.Options
+	}
+	if g, ok := t.Groups[group]; ok && g.Options != nil {
+		return g.Options
+	}
+	return def
+}
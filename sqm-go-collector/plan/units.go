@@ -0,0 +1,107 @@
+package plan
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Unit is a chart unit label with the multiplier and divisor Netdata applies to
+// the collected base values (bytes for traffic, microseconds for latency).
+type Unit struct {
+	Label string `json:"label"`
+	Mul   int    `json:"mul"`
+	Div   int    `json:"div"`
+}
+
+// Default units, matching the charts of the shell collector.
+var (
+	DefaultTrafficUnit = TrafficUnits["kbit"]
+	DefaultLatencyUnit = LatencyUnits["ms"]
+)
+
+// TrafficUnits maps -traffic-units names to units for byte counters: bits or
+// bytes per second with SI (k = 1000) or binary (Ki = 1024) prefixes.
+var TrafficUnits = map[string]Unit{
+	"bit":    {"b/s", 8, 1},
+	"kbit":   {"Kb/s", 1, 125},
+	"mbit":   {"Mb/s", 1, 125000},
+	"gbit":   {"Gb/s", 1, 125000000},
+	"kibit":  {"Kib/s", 1, 128},
+	"mibit":  {"Mib/s", 1, 131072},
+	"gibit":  {"Gib/s", 1, 134217728},
+	"byte":   {"B/s", 1, 1},
+	"kbyte":  {"KB/s", 1, 1000},
+	"mbyte":  {"MB/s", 1, 1000000},
+	"gbyte":  {"GB/s", 1, 1000000000},
+	"kibyte": {"KiB/s", 1, 1024},
+	"mibyte": {"MiB/s", 1, 1048576},
+	"gibyte": {"GiB/s", 1, 1073741824},
+}
+
+// LatencyUnits maps -latency-units names to units for microsecond delays.
+var LatencyUnits = map[string]Unit{
+	"us": {"µs", 1, 1},
+	"ms": {"ms", 1, 1000},
+}
+
+// ParseTrafficUnit returns the traffic unit called name.
+func ParseTrafficUnit(name string) (Unit, error) {
+	return parseUnit(TrafficUnits, name)
+}
+
+// ParseLatencyUnit returns the latency unit called name.
+func ParseLatencyUnit(name string) (Unit, error) {
+	return parseUnit(LatencyUnits, name)
+}
+
+// UnitNames returns the names of units in a sorted list.
+func UnitNames(units map[string]Unit) []string {
+	names := make([]string, 0, len(units))
+	for name := range units {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func parseUnit(units map[string]Unit, name string) (Unit, error) {
+	u, ok := units[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return Unit{}, fmt.Errorf("unknown unit %q (expected %s)", name, strings.Join(UnitNames(units), "|"))
+	}
+	return u, nil
+}
+
+// Scale converts a base value (bytes/s or microseconds) to u, the value Netdata
+// shows for a dimension of u collecting v.
+func (u Unit) Scale(v float64) float64 {
+	return v * float64(u.Mul) / float64(u.Div)
+}
+
+// Name returns the -traffic-units or -latency-units name of u, e.g. "kbit" or
+// "ms", used as the suffix of metric names in u.
+func (u Unit) Name() string {
+	for _, units := range []map[string]Unit{TrafficUnits, LatencyUnits} {
+		for name, v := range units {
+			if v == u {
+				return name
+			}
+		}
+	}
+	return SanitizeKey(strings.ToLower(u.Label))
+}
+
+// Units returns the traffic and latency units of cfg, with the defaults for
+// unset ones.
+func (cfg Config) Units() (traffic, latency Unit) {
+	return cfg.TrafficUnit.orDefault(DefaultTrafficUnit), cfg.LatencyUnit.orDefault(DefaultLatencyUnit)
+}
+
+// orDefault returns u, or def for the zero Unit.
+func (u Unit) orDefault(def Unit) Unit {
+	if u.Div == 0 {
+		return def
+	}
+	return u
+}
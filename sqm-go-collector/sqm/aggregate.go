@@ -0,0 +1,150 @@
+package sqm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Aggregation selects how the latency metrics of cake_mq child queues are
+// combined into the aggregated "all" queue. Counters are always summed.
+type Aggregation struct {
+	Target string
+	Peak   string
+	Avg    string
+	Base   string
+}
+
+// Aggregation policies.
+const (
+	AggMax        = "max"
+	AggMin        = "min"
+	AggByteMean   = "byte-mean"
+	AggPacketMean = "packet-mean"
+)
+
+// DefaultAggregation reports the worst child queue for every latency metric.
+var DefaultAggregation = Aggregation{Target: AggMax, Peak: AggMax, Avg: AggMax, Base: AggMax}
+
+// ParseAggregation parses "metric=policy" pairs, e.g. "peak=max,avg=byte-mean".
+// Metrics not mentioned keep the default policy.
+func ParseAggregation(v string) (Aggregation, error) {
+	agg := DefaultAggregation
+	for _, pair := range splitNonEmpty(v, ",") {
+		metric, policy, ok := strings.Cut(pair, "=")
+		if !ok {
+			return Aggregation{}, fmt.Errorf("invalid aggregation %q (expected metric=policy)", pair)
+		}
+		policy = strings.TrimSpace(policy)
+		switch policy {
+		case AggMax, AggMin, AggByteMean, AggPacketMean:
+		default:
+			return Aggregation{}, fmt.Errorf("invalid aggregation policy %q (expected max|min|byte-mean|packet-mean)", policy)
+		}
+		switch strings.TrimSpace(metric) {
+		case "target":
+			agg.Target = policy
+		case "peak":
+			agg.Peak = policy
+		case "avg":
+			agg.Avg = policy
+		case "base":
+			agg.Base = policy
+		default:
+			return Aggregation{}, fmt.Errorf("invalid aggregation metric %q (expected target|peak|avg|base)", metric)
+		}
+	}
+	return agg, nil
+}
+
+// TinSpread is the min/max of each latency metric across the aggregated child
+// queues, so the aggregate does not hide queue imbalance.
+type TinSpread struct {
+	TargetMinUS uint64 `json:"target_min_us"`
+	TargetMaxUS uint64 `json:"target_max_us"`
+	PeakMinUS   uint64 `json:"peak_delay_min_us"`
+	PeakMaxUS   uint64 `json:"peak_delay_max_us"`
+	AvgMinUS    uint64 `json:"avg_delay_min_us"`
+	AvgMaxUS    uint64 `json:"avg_delay_max_us"`
+	BaseMinUS   uint64 `json:"base_delay_min_us"`
+	BaseMaxUS   uint64 `json:"base_delay_max_us"`
+}
+
+// childTin is one child queue's tin of an aggregated cake_mq queue: its
+// latency metrics and lifetime counters, kept on the aggregated tin so that
+// State.Observe can weight the means by the traffic of the interval.
+type childTin struct {
+	queueID, handle         string
+	target, peak, avg, base uint64
+	sentBytes, sentPackets  uint64
+}
+
+// childWeight is the bytes and packets a child queue's tin sent in the last
+// interval.
+type childWeight struct {
+	bytes, packets float64
+}
+
+type latencySample struct {
+	value uint64
+	childWeight
+}
+
+// combineTin sets the latency metrics and spread of the aggregated tin a from
+// its children with policy. weights holds the interval traffic of each child;
+// without it (no previous sample) the weighted means fall back to the plain
+// mean.
+func combineTin(a *TinMetrics, policy Aggregation, children []childTin, weights []childWeight) {
+	target := make([]latencySample, len(children))
+	peak := make([]latencySample, len(children))
+	avg := make([]latencySample, len(children))
+	base := make([]latencySample, len(children))
+	for i, c := range children {
+		var w childWeight
+		if weights != nil {
+			w = weights[i]
+		}
+		target[i] = latencySample{c.target, w}
+		peak[i] = latencySample{c.peak, w}
+		avg[i] = latencySample{c.avg, w}
+		base[i] = latencySample{c.base, w}
+	}
+	sp := &TinSpread{}
+	a.TargetUS, sp.TargetMinUS, sp.TargetMaxUS = combineLatency(policy.Target, target)
+	a.PeakDelayUS, sp.PeakMinUS, sp.PeakMaxUS = combineLatency(policy.Peak, peak)
+	a.AvgDelayUS, sp.AvgMinUS, sp.AvgMaxUS = combineLatency(policy.Avg, avg)
+	a.BaseDelayUS, sp.BaseMinUS, sp.BaseMaxUS = combineLatency(policy.Base, base)
+	a.Spread = sp
+}
+
+// combineLatency reduces one latency metric of a tin across child queues.
+// Weighted means use the bytes or packets each child sent in the interval;
+// when no child has sent anything the plain mean is used instead.
+func combineLatency(policy string, samples []latencySample) (v, lo, hi uint64) {
+	if len(samples) == 0 {
+		return 0, 0, 0
+	}
+	lo, hi = samples[0].value, samples[0].value
+	var sum, weighted, weights float64
+	for _, s := range samples {
+		lo = min(lo, s.value)
+		hi = max(hi, s.value)
+		sum += float64(s.value)
+		w := s.bytes
+		if policy == AggPacketMean {
+			w = s.packets
+		}
+		weighted += float64(s.value) * w
+		weights += w
+	}
+	switch policy {
+	case AggMin:
+		return lo, lo, hi
+	case AggByteMean, AggPacketMean:
+		if weights == 0 {
+			return uint64(sum/float64(len(samples)) + 0.5), lo, hi
+		}
+		return uint64(weighted/weights + 0.5), lo, hi
+	default:
+		return hi, lo, hi
+	}
+}
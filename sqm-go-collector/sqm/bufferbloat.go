@@ -0,0 +1,121 @@
+package sqm
+
+import (
+	"math"
+	"time"
+)
+
+// Defaults of the bufferbloat grade configuration.
+const (
+	DefaultBloatLoadPct = 50
+	DefaultBloatWindow  = 60 * time.Second
+)
+
+// Bufferbloat grades the latency an interface adds while it is loaded, using
+// the thresholds of the common bufferbloat tests (latency increase under load:
+// A+ < 5 ms, A < 30 ms, B < 60 ms, C < 200 ms, D < 400 ms, F otherwise).
+type Bufferbloat struct {
+	Grade         string  `json:"grade"`
+	Score         int     `json:"score"`
+	LatencyUS     float64 `json:"latency_us"`
+	PeakLatencyUS float64 `json:"peak_latency_us"`
+	Loaded        bool    `json:"loaded"`
+	Samples       int     `json:"samples"`
+}
+
+// BloatState is the rolling (exponentially weighted) latency under load of one
+// interface, kept in State between samples.
+type BloatState struct {
+	LatencyUS     float64 `json:"latency_us"`
+	PeakLatencyUS float64 `json:"peak_latency_us"`
+	Samples       int     `json:"samples"`
+}
+
+var bloatGrades = []struct {
+	grade   string
+	score   int
+	limitUS float64
+}{
+	{"A+", 5, 5000},
+	{"A", 4, 30000},
+	{"B", 3, 60000},
+	{"C", 2, 200000},
+	{"D", 1, 400000},
+}
+
+func bloatGrade(latencyUS float64) (string, int) {
+	for _, g := range bloatGrades {
+		if latencyUS < g.limitUS {
+			return g.grade, g.score
+		}
+	}
+	return "F", 0
+}
+
+// loadedLatency returns the byte-rate weighted average and peak delay of the
+// tins of rep, and whether any tin ran at or above loadPct of its threshold.
+func loadedLatency(rep InterfaceReport, loadPct float64) (avgUS, peakUS float64, loaded, ok bool) {
+	var weights float64
+	for _, q := range rep.Queues {
+		for _, tin := range q.Tins {
+			r := tin.Rates
+			if r == nil {
+				continue
+			}
+			ok = true
+			if tin.ThresholdRate > 0 && r.Utilisation >= loadPct {
+				loaded = true
+			}
+			weights += r.SentBytes
+			avgUS += float64(tin.AvgDelayUS) * r.SentBytes
+			peakUS += float64(tin.PeakDelayUS) * r.SentBytes
+		}
+	}
+	if weights > 0 {
+		avgUS /= weights
+		peakUS /= weights
+	}
+	return avgUS, peakUS, loaded, ok
+}
+
+// updateBloat folds the current interval into the rolling latency of each
+// interface and attaches the resulting grade. Only loaded intervals move the
+// rolling value; idle intervals keep the last grade.
+func (s *State) updateBloat(prev map[string]BloatState, out *Result, dt float64) {
+	loadPct := s.BloatLoadPct
+	if loadPct <= 0 {
+		loadPct = DefaultBloatLoadPct
+	}
+	window := s.BloatWindow
+	if window <= 0 {
+		window = DefaultBloatWindow
+	}
+
+	for ri := range out.Reports {
+		rep := &out.Reports[ri]
+		st, seen := prev[rep.Interface]
+		avgUS, peakUS, loaded, ok := loadedLatency(*rep, loadPct)
+		if !ok {
+			if seen {
+				s.Bloat[rep.Interface] = st
+			}
+			continue
+		}
+		if loaded {
+			alpha := 1 - math.Exp(-dt/window.Seconds())
+			if st.Samples == 0 {
+				alpha = 1
+			}
+			st.LatencyUS += alpha * (avgUS - st.LatencyUS)
+			st.PeakLatencyUS += alpha * (peakUS - st.PeakLatencyUS)
+			st.Samples++
+		}
+		s.Bloat[rep.Interface] = st
+
+		bb := &Bufferbloat{Loaded: loaded, Samples: st.Samples, LatencyUS: st.LatencyUS, PeakLatencyUS: st.PeakLatencyUS}
+		if st.Samples > 0 {
+			bb.Grade, bb.Score = bloatGrade(st.LatencyUS)
+		}
+		rep.Bufferbloat = bb
+	}
+}
@@ -0,0 +1,260 @@
+package sqm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/tcstats"
+)
+
+// Collector collects the reports of a set of interfaces. A nil Source runs tc
+// from PATH.
+type Collector struct {
+	Source      tcstats.Source
+	Interfaces  []string
+	Mode        string
+	Aggregation Aggregation
+}
+
+// Collect returns one sample of all interfaces. Counters are the raw tc values;
+// pass the result through State.Observe for rates and reset handling.
+func (c Collector) Collect() (Result, error) {
+	src := c.Source
+	if src == nil {
+		src = tcstats.Exec{}
+	}
+	out := Result{Reports: make([]InterfaceReport, 0, len(c.Interfaces))}
+	for _, ifc := range c.Interfaces {
+		report, err := CollectInterface(src, ifc, c.Mode, c.Aggregation)
+		if err != nil {
+			return Result{}, fmt.Errorf("%s: %w", ifc, err)
+		}
+		out.Reports = append(out.Reports, report)
+	}
+	return out, nil
+}
+
+// CollectInterface reads the qdiscs of ifc from src and builds its report in
+// the given mode. agg only applies to a cake_mq root in ModeCakeMQ.
+func CollectInterface(src tcstats.Source, ifc, mode string, agg Aggregation) (InterfaceReport, error) {
+	all, err := src.Qdiscs(ifc)
+	if err != nil {
+		return InterfaceReport{}, err
+	}
+	root, ok := tcstats.Root(all)
+	if !ok {
+		return InterfaceReport{}, errors.New("no root qdisc found")
+	}
+
+	report := InterfaceReport{
+		Interface:  ifc,
+		Mode:       mode,
+		RootKind:   root.Kind,
+		RootHandle: root.Handle,
+		Bandwidth:  uint64(root.Options.Bandwidth),
+		Overview:   overviewFromQdisc(root),
+	}
+
+	switch root.Kind {
+	case "cake":
+		report.Queues = []QueueReport{queueFromQdisc(root, "root")}
+		return report, nil
+	case "cake_mq":
+		children := make([]tcstats.Qdisc, 0)
+		for _, q := range all {
+			if q.Kind == "cake" && strings.HasPrefix(q.Parent, root.Handle) {
+				children = append(children, q)
+			}
+		}
+		if len(children) == 0 {
+			return InterfaceReport{}, errors.New("cake_mq root without child cake queues")
+		}
+		sort.Slice(children, func(i, j int) bool {
+			return queueID(root.Handle, children[i].Parent) < queueID(root.Handle, children[j].Parent)
+		})
+
+		report.Imbalance = imbalanceFromChildren(root.Handle, children)
+
+		if report.Bandwidth == 0 {
+			for _, c := range children {
+				report.Bandwidth += uint64(c.Options.Bandwidth)
+			}
+		}
+
+		if mode == ModeCakeMQ {
+			all := aggregateQueues(root, children, agg)
+			all.Bandwidth = report.Bandwidth
+			all.Options.Bandwidth = tcstats.Rate(report.Bandwidth)
+			report.Queues = []QueueReport{all}
+		} else {
+			report.Queues = make([]QueueReport, 0, len(children))
+			for _, c := range children {
+				report.Queues = append(report.Queues, queueFromQdisc(c, queueID(root.Handle, c.Parent)))
+			}
+		}
+		return report, nil
+	case "mq", "fq_codel":
+		report.Queues = []QueueReport{{
+			QueueID:  "root",
+			Handle:   root.Handle,
+			Parent:   "",
+			Overview: overviewFromQdisc(root),
+		}}
+		return report, nil
+	default:
+		return InterfaceReport{}, fmt.Errorf("unsupported root qdisc kind %q", root.Kind)
+	}
+}
+
+func overviewFromQdisc(q tcstats.Qdisc) Overview {
+	return Overview{
+		Bytes:      q.Bytes,
+		Packets:    q.Packets,
+		Drops:      q.Drops,
+		Overlimits: q.Overlimits,
+		Requeues:   q.Requeues,
+		Backlog:    q.Backlog,
+		Qlen:       q.Qlen,
+	}
+}
+
+func queueFromQdisc(q tcstats.Qdisc, id string) QueueReport {
+	tins := make([]TinMetrics, 0, len(q.Tins))
+	labels := tinLabels(q.Options.Diffserv, len(q.Tins))
+	for i, t := range q.Tins {
+		tins = append(tins, TinMetrics{
+			Tin:               labels[i],
+			ThresholdRate:     t.ThresholdRate,
+			SentBytes:         t.SentBytes,
+			BacklogBytes:      t.BacklogBytes,
+			TargetUS:          t.TargetUS,
+			PeakDelayUS:       t.PeakDelayUS,
+			AvgDelayUS:        t.AvgDelayUS,
+			BaseDelayUS:       t.BaseDelayUS,
+			SentPackets:       t.SentPackets,
+			Drops:             t.Drops,
+			ECNMark:           t.ECNMark,
+			AckDrops:          t.AckDrops,
+			SparseFlows:       t.SparseFlows,
+			BulkFlows:         t.BulkFlows,
+			UnresponsiveFlows: t.UnresponsiveFlows,
+		})
+	}
+	opts := q.Options
+	return QueueReport{
+		QueueID:   id,
+		Handle:    q.Handle,
+		Parent:    q.Parent,
+		Bandwidth: uint64(q.Options.Bandwidth),
+		Options:   &opts,
+		Overview:  overviewFromQdisc(q),
+		Tins:      tins,
+	}
+}
+
+func aggregateQueues(root tcstats.Qdisc, children []tcstats.Qdisc, policy Aggregation) QueueReport {
+	numTins := len(children[0].Tins)
+	labels := tinLabels(children[0].Options.Diffserv, numTins)
+	opts := children[0].Options
+	agg := QueueReport{
+		QueueID:  "all",
+		Handle:   root.Handle,
+		Parent:   root.Handle,
+		Options:  &opts,
+		Overview: overviewFromQdisc(root),
+		Tins:     make([]TinMetrics, numTins),
+	}
+	for i := 0; i < numTins; i++ {
+		agg.Tins[i].Tin = labels[i]
+	}
+	tinChildren := make([][]childTin, numTins)
+	for _, c := range children {
+		id := queueID(root.Handle, c.Parent)
+		for i, t := range c.Tins {
+			if i >= numTins {
+				break
+			}
+			a := &agg.Tins[i]
+			a.ThresholdRate += t.ThresholdRate
+			a.SentBytes += t.SentBytes
+			a.BacklogBytes += t.BacklogBytes
+			a.SentPackets += t.SentPackets
+			a.Drops += t.Drops
+			a.ECNMark += t.ECNMark
+			a.AckDrops += t.AckDrops
+			a.SparseFlows += t.SparseFlows
+			a.BulkFlows += t.BulkFlows
+			a.UnresponsiveFlows += t.UnresponsiveFlows
+
+			tinChildren[i] = append(tinChildren[i], childTin{
+				queueID: id, handle: c.Handle,
+				target: t.TargetUS, peak: t.PeakDelayUS, avg: t.AvgDelayUS, base: t.BaseDelayUS,
+				sentBytes: t.SentBytes, sentPackets: t.SentPackets,
+			})
+		}
+	}
+	for i := range agg.Tins {
+		a := &agg.Tins[i]
+		combineTin(a, policy, tinChildren[i], nil)
+		a.children = tinChildren[i]
+	}
+	agg.aggregation = policy
+	return agg
+}
+
+func queueID(rootHandle, parent string) string {
+	id := strings.TrimPrefix(parent, rootHandle)
+	if id == parent || id == "" {
+		return "0"
+	}
+	var b strings.Builder
+	for _, r := range id {
+		if (r >= '0' && r <= '9') || (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') {
+			b.WriteRune(r)
+		}
+	}
+	out := b.String()
+	if out == "" {
+		return "0"
+	}
+	return out
+}
+
+func tinLabels(diffserv string, count int) []string {
+	var base []string
+	switch diffserv {
+	case "besteffort":
+		base = []string{"T0"}
+	case "diffserv3":
+		base = []string{"BK", "BE", "VI"}
+	case "diffserv4":
+		base = []string{"BK", "BE", "VI", "VO"}
+	case "diffserv5":
+		base = []string{"LE", "BK", "BE", "VI", "VO"}
+	default:
+		base = []string{"T0", "T1", "T2", "T3", "T4", "T5", "T6", "T7"}
+	}
+	labels := make([]string, count)
+	for i := 0; i < count; i++ {
+		if i < len(base) {
+			labels[i] = base[i]
+		} else {
+			labels[i] = fmt.Sprintf("T%d", i)
+		}
+	}
+	return labels
+}
+
+func splitNonEmpty(v, sep string) []string {
+	parts := strings.Split(v, sep)
+	out := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
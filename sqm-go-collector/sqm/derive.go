@@ -0,0 +1,85 @@
+package sqm
+
+// DeriveMetrics fills the metrics computed from per-second rates. It runs after
+// State.Observe has attached rates for the current interval.
+func DeriveMetrics(out *Result) {
+	for ri := range out.Reports {
+		rep := &out.Reports[ri]
+		var ifcPackets congestion
+		for qi := range rep.Queues {
+			q := &rep.Queues[qi]
+			var qPackets congestion
+			for ti := range q.Tins {
+				tin := &q.Tins[ti]
+				r := tin.Rates
+				if r == nil {
+					continue
+				}
+				r.AvgPacketSize = packetSize(r.SentBytes, r.SentPackets)
+				if tin.ThresholdRate > 0 {
+					r.Utilisation = utilisation(r.SentBytes, tin.ThresholdRate)
+				}
+				c := congestion{sent: r.SentPackets, drops: r.Drops, marks: r.ECNMark, acks: r.AckDrops}
+				r.DropRatio, r.ECNRatio, r.AckRatio = c.ratios()
+				qPackets.add(c)
+			}
+			if r := q.Overview.Rates; r != nil {
+				r.AvgPacketSize = packetSize(r.Bytes, r.Packets)
+				if q.Bandwidth > 0 {
+					r.Utilisation = utilisation(r.Bytes, q.Bandwidth)
+				}
+				r.DropRatio, r.ECNRatio, r.AckRatio = qPackets.ratios()
+			}
+			ifcPackets.add(qPackets)
+		}
+		if rep.Imbalance != nil {
+			rep.Imbalance.compute()
+		}
+		if r := rep.Overview.Rates; r != nil {
+			r.AvgPacketSize = packetSize(r.Bytes, r.Packets)
+			if rep.Bandwidth > 0 {
+				r.Utilisation = utilisation(r.Bytes, rep.Bandwidth)
+			}
+			r.DropRatio, r.ECNRatio, r.AckRatio = ifcPackets.ratios()
+		}
+	}
+}
+
+// utilisation returns the sent rate as a percentage of a shaper rate. Both are
+// in bytes per second, as reported by tc.
+func utilisation(rate float64, limit uint64) float64 {
+	return rate / float64(limit) * 100
+}
+
+func packetSize(bytes, packets float64) float64 {
+	if packets <= 0 {
+		return 0
+	}
+	return bytes / packets
+}
+
+// congestion holds per-second packet rates of one tin or a sum of tins.
+// sent_packets only counts packets that left the queue, so dropped packets are
+// added back for the drop and ACK-filter ratios.
+type congestion struct {
+	sent, drops, marks, acks float64
+}
+
+func (c *congestion) add(o congestion) {
+	c.sent += o.sent
+	c.drops += o.drops
+	c.marks += o.marks
+	c.acks += o.acks
+}
+
+// ratios returns the drop, ECN mark and ACK-filter ratios in per-mille.
+func (c congestion) ratios() (drop, ecn, ack float64) {
+	return perMille(c.drops, c.sent+c.drops), perMille(c.marks, c.sent), perMille(c.acks, c.sent+c.acks)
+}
+
+func perMille(part, total float64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return part / total * 1000
+}
@@ -0,0 +1,12 @@
+// Package sqm builds per-interface reports of SQM qdisc statistics: it
+// collects cake, cake_mq, mq and fq_codel qdiscs through tcstats, aggregates
+// cake_mq child queues, and keeps the state needed for rates, counter-reset
+// handling, bufferbloat grading and shaper rate tracking between samples.
+//
+// The Go API of this module (packages tcstats, sqm, plan and emit) follows
+// semantic versioning through tags of the form sqm-go-collector/vX.Y.Z.
+// Until v1.0.0 minor versions may change it; Version names the current one.
+package sqm
+
+// Version is the version of the Go API of this module.
+const Version = "0.1.0"
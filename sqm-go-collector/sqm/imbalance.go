@@ -0,0 +1,107 @@
+package sqm
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/tcstats"
+)
+
+// QueueImbalance summarises how evenly a cake_mq root spreads load over its
+// child queues. It is reported in every mode, so RSS/XPS problems show up
+// without switching to queue or overlay charts.
+type QueueImbalance struct {
+	Queues          []QueueLoad `json:"queues"`
+	ThroughputCV    float64     `json:"throughput_cv"`
+	BusiestQueue    string      `json:"busiest_queue"`
+	PeakMaxOverMean float64     `json:"peak_delay_max_over_mean"`
+}
+
+// QueueLoad is the throughput share and peak delay of one child queue.
+type QueueLoad struct {
+	QueueID     string   `json:"queue_id"`
+	Handle      string   `json:"handle"`
+	Bytes       uint64   `json:"bytes"`
+	BytesRate   *float64 `json:"bytes_rate,omitempty"`
+	PeakDelayUS uint64   `json:"peak_delay_us"`
+	Share       float64  `json:"share_pct"`
+}
+
+func imbalanceFromChildren(rootHandle string, children []tcstats.Qdisc) *QueueImbalance {
+	im := &QueueImbalance{Queues: make([]QueueLoad, 0, len(children))}
+	for _, c := range children {
+		var peak uint64
+		for _, t := range c.Tins {
+			peak = max(peak, t.PeakDelayUS)
+		}
+		im.Queues = append(im.Queues, QueueLoad{
+			QueueID:     queueID(rootHandle, c.Parent),
+			Handle:      c.Handle,
+			Bytes:       c.Bytes,
+			PeakDelayUS: peak,
+		})
+	}
+	im.compute()
+	return im
+}
+
+// compute fills the shares and summary values from the per-queue throughput:
+// the byte rate when every queue has one, the cumulative bytes otherwise.
+func (im *QueueImbalance) compute() {
+	n := len(im.Queues)
+	if n == 0 {
+		return
+	}
+	useRates := true
+	for _, q := range im.Queues {
+		if q.BytesRate == nil {
+			useRates = false
+			break
+		}
+	}
+
+	load := make([]float64, n)
+	var total, peakSum float64
+	var peakMax uint64
+	busiest := 0
+	for i, q := range im.Queues {
+		if useRates {
+			load[i] = *q.BytesRate
+		} else {
+			load[i] = float64(q.Bytes)
+		}
+		total += load[i]
+		if load[i] > load[busiest] {
+			busiest = i
+		}
+		peakSum += float64(q.PeakDelayUS)
+		peakMax = max(peakMax, q.PeakDelayUS)
+	}
+
+	mean := total / float64(n)
+	var variance float64
+	for i := range im.Queues {
+		if total > 0 {
+			im.Queues[i].Share = load[i] / total * 100
+		} else {
+			im.Queues[i].Share = 0
+		}
+		variance += (load[i] - mean) * (load[i] - mean)
+	}
+	im.ThroughputCV = 0
+	if mean > 0 {
+		im.ThroughputCV = math.Sqrt(variance/float64(n)) / mean
+	}
+	im.BusiestQueue = im.Queues[busiest].QueueID
+	im.PeakMaxOverMean = 0
+	if peakSum > 0 {
+		im.PeakMaxOverMean = float64(peakMax) / (peakSum / float64(n))
+	}
+}
+
+// BusiestQueueNumber returns the busiest queue ID as a number for charting.
+// Queue IDs are tc minor handles, so they are parsed as hexadecimal.
+func (im *QueueImbalance) BusiestQueueNumber() (uint64, bool) {
+	v, err := strconv.ParseUint(im.BusiestQueue, 16, 64)
+	return v, err == nil
+}
@@ -0,0 +1,87 @@
+package sqm
+
+import (
+	"math"
+	"sort"
+)
+
+// LatencyStats summarises the delay snapshots taken between two emitted
+// samples in daemon mode with -sample-rate, so spikes shorter than the chart
+// interval are not lost.
+type LatencyStats struct {
+	Peak WindowStats `json:"peak_delay"`
+	Avg  WindowStats `json:"avg_delay"`
+}
+
+// WindowStats summarises the snapshots of one delay metric.
+type WindowStats struct {
+	MinUS   uint64  `json:"min_us"`
+	MeanUS  float64 `json:"mean_us"`
+	MaxUS   uint64  `json:"max_us"`
+	P95US   uint64  `json:"p95_us"`
+	Samples int     `json:"samples"`
+}
+
+// LatencySampler collects delay snapshots between two emitted samples.
+type LatencySampler struct {
+	peak map[string][]uint64
+	avg  map[string][]uint64
+}
+
+// NewLatencySampler returns an empty sampler.
+func NewLatencySampler() *LatencySampler {
+	return &LatencySampler{peak: make(map[string][]uint64), avg: make(map[string][]uint64)}
+}
+
+// Add records the tin delays of a snapshot.
+func (ls *LatencySampler) Add(out Result) {
+	for _, rep := range out.Reports {
+		for _, q := range rep.Queues {
+			for _, tin := range q.Tins {
+				key := rep.Interface + "/" + q.QueueID + "/" + tin.Tin
+				ls.peak[key] = append(ls.peak[key], tin.PeakDelayUS)
+				ls.avg[key] = append(ls.avg[key], tin.AvgDelayUS)
+			}
+		}
+	}
+}
+
+// Attach sets the window statistics on the tins of out and starts a new window.
+func (ls *LatencySampler) Attach(out *Result) {
+	for ri := range out.Reports {
+		rep := &out.Reports[ri]
+		for qi := range rep.Queues {
+			q := &rep.Queues[qi]
+			for ti := range q.Tins {
+				tin := &q.Tins[ti]
+				key := rep.Interface + "/" + q.QueueID + "/" + tin.Tin
+				if len(ls.peak[key]) == 0 {
+					continue
+				}
+				tin.LatencyStats = &LatencyStats{Peak: summarise(ls.peak[key]), Avg: summarise(ls.avg[key])}
+			}
+		}
+	}
+	clear(ls.peak)
+	clear(ls.avg)
+}
+
+// summarise sorts values in place. The p95 uses the nearest-rank method.
+func summarise(values []uint64) WindowStats {
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	var sum float64
+	for _, v := range values {
+		sum += float64(v)
+	}
+	rank := int(math.Ceil(0.95*float64(len(values)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return WindowStats{
+		MinUS:   values[0],
+		MeanUS:  sum / float64(len(values)),
+		MaxUS:   values[len(values)-1],
+		P95US:   values[rank],
+		Samples: len(values),
+	}
+}
@@ -0,0 +1,92 @@
+package sqm
+
+import "github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/tcstats"
+
+// Report modes: cake_mq aggregates the child queues of a cake_mq root into one
+// queue, queue reports each child queue separately and overlay reports each
+// child queue on shared per-tin charts.
+const (
+	ModeCakeMQ  = "cake_mq"
+	ModeQueue   = "queue"
+	ModeOverlay = "overlay"
+)
+
+// ValidMode reports whether mode is one of the report modes.
+func ValidMode(mode string) bool {
+	return mode == ModeCakeMQ || mode == ModeQueue || mode == ModeOverlay
+}
+
+// Overview holds the qdisc-level counters of an interface or queue.
+type Overview struct {
+	Bytes      uint64         `json:"bytes"`
+	Packets    uint64         `json:"packets"`
+	Drops      uint64         `json:"drops"`
+	Overlimits uint64         `json:"overlimits"`
+	Requeues   uint64         `json:"requeues"`
+	Backlog    uint64         `json:"backlog"`
+	Qlen       uint64         `json:"qlen"`
+	Rates      *OverviewRates `json:"rates,omitempty"`
+}
+
+// TinMetrics holds the statistics of one CAKE tin, labelled by its diffserv
+// name (e.g. "BE") or "T<n>".
+type TinMetrics struct {
+	Tin               string        `json:"tin"`
+	ThresholdRate     uint64        `json:"threshold_rate"`
+	SentBytes         uint64        `json:"sent_bytes"`
+	BacklogBytes      uint64        `json:"backlog_bytes"`
+	TargetUS          uint64        `json:"target_us"`
+	PeakDelayUS       uint64        `json:"peak_delay_us"`
+	AvgDelayUS        uint64        `json:"avg_delay_us"`
+	BaseDelayUS       uint64        `json:"base_delay_us"`
+	SentPackets       uint64        `json:"sent_packets"`
+	Drops             uint64        `json:"drops"`
+	ECNMark           uint64        `json:"ecn_mark"`
+	AckDrops          uint64        `json:"ack_drops"`
+	SparseFlows       uint64        `json:"sparse_flows"`
+	BulkFlows         uint64        `json:"bulk_flows"`
+	UnresponsiveFlows uint64        `json:"unresponsive_flows"`
+	Spread            *TinSpread    `json:"spread,omitempty"`
+	LatencyStats      *LatencyStats `json:"latency_stats,omitempty"`
+	Rates             *TinRates     `json:"rates,omitempty"`
+
+	// children holds the child queue tins of an aggregated cake_mq tin.
+	children []childTin
+}
+
+// QueueReport is one cake qdisc: the root of a plain cake setup, a cake_mq
+// child queue, or the aggregate of all child queues ("all"). Options are the
+// CAKE options of the qdisc, or of the first child queue for "all".
+type QueueReport struct {
+	QueueID   string           `json:"queue_id"`
+	Handle    string           `json:"handle"`
+	Parent    string           `json:"parent"`
+	Bandwidth uint64           `json:"bandwidth"`
+	Options   *tcstats.Options `json:"options,omitempty"`
+	Overview  Overview         `json:"overview"`
+	Tins      []TinMetrics     `json:"tins"`
+
+	// aggregation is the latency policy of an aggregated cake_mq queue.
+	aggregation Aggregation
+}
+
+// InterfaceReport is the report of one interface.
+type InterfaceReport struct {
+	Interface       string           `json:"interface"`
+	Mode            string           `json:"mode"`
+	RootKind        string           `json:"root_kind"`
+	RootHandle      string           `json:"root_handle"`
+	Bandwidth       uint64           `json:"bandwidth"`
+	Overview        Overview         `json:"overview"`
+	Imbalance       *QueueImbalance  `json:"imbalance,omitempty"`
+	Bufferbloat     *Bufferbloat     `json:"bufferbloat,omitempty"`
+	RateAdjustments *RateAdjustments `json:"rate_adjustments,omitempty"`
+	Queues          []QueueReport    `json:"queues"`
+}
+
+// Result is one sample of all collected interfaces. IntervalSeconds is set by
+// State.Observe once a previous sample is known.
+type Result struct {
+	IntervalSeconds float64           `json:"interval_seconds,omitempty"`
+	Reports         []InterfaceReport `json:"reports"`
+}
@@ -0,0 +1,91 @@
+package sqm
+
+import "time"
+
+const maxRateEvents = 16
+
+// RateAdjustments tracks changes of the shaper rate, e.g. by cake-autorate
+// rewriting the CAKE bandwidth, which also moves every tin threshold_rate.
+type RateAdjustments struct {
+	Changes           uint64      `json:"changes"`
+	LastChange        *time.Time  `json:"last_change,omitempty"`
+	Bandwidth         uint64      `json:"bandwidth"`
+	PreviousBandwidth uint64      `json:"previous_bandwidth"`
+	Events            []RateEvent `json:"events"`
+}
+
+// RateEvent records one changed rate. Target is "bandwidth" for the qdisc or
+// "<queue>/<tin>" for a tin threshold.
+type RateEvent struct {
+	Time     time.Time `json:"time"`
+	Target   string    `json:"target"`
+	Previous uint64    `json:"previous"`
+	Current  uint64    `json:"current"`
+}
+
+// ShaperState is the shaper history of one interface, kept in State between
+// samples.
+type ShaperState struct {
+	Bandwidth         uint64            `json:"bandwidth"`
+	PreviousBandwidth uint64            `json:"previous_bandwidth"`
+	Thresholds        map[string]uint64 `json:"thresholds"`
+	Changes           uint64            `json:"changes"`
+	LastChange        time.Time         `json:"last_change"`
+	Events            []RateEvent       `json:"events"`
+}
+
+// updateShaper compares the shaper rates of out with the previous sample. A
+// sample in which any rate moved counts as one adjustment; every moved rate
+// is logged as an event.
+func (s *State) updateShaper(prev map[string]ShaperState, out *Result, now time.Time) {
+	for ri := range out.Reports {
+		rep := &out.Reports[ri]
+		st, seen := prev[rep.Interface]
+
+		thresholds := make(map[string]uint64)
+		for _, q := range rep.Queues {
+			for _, tin := range q.Tins {
+				thresholds[q.QueueID+"/"+tin.Tin] = tin.ThresholdRate
+			}
+		}
+
+		if seen {
+			events := make([]RateEvent, 0)
+			if st.Bandwidth != rep.Bandwidth {
+				events = append(events, RateEvent{Time: now, Target: "bandwidth", Previous: st.Bandwidth, Current: rep.Bandwidth})
+				st.PreviousBandwidth = st.Bandwidth
+			}
+			for _, q := range rep.Queues {
+				for _, tin := range q.Tins {
+					key := q.QueueID + "/" + tin.Tin
+					if old, ok := st.Thresholds[key]; ok && old != tin.ThresholdRate {
+						events = append(events, RateEvent{Time: now, Target: key, Previous: old, Current: tin.ThresholdRate})
+					}
+				}
+			}
+			if len(events) > 0 {
+				st.Changes++
+				st.LastChange = now
+				st.Events = append(st.Events, events...)
+				if len(st.Events) > maxRateEvents {
+					st.Events = st.Events[len(st.Events)-maxRateEvents:]
+				}
+			}
+		}
+		st.Bandwidth = rep.Bandwidth
+		st.Thresholds = thresholds
+		s.Shaper[rep.Interface] = st
+
+		ra := &RateAdjustments{
+			Changes:           st.Changes,
+			Bandwidth:         st.Bandwidth,
+			PreviousBandwidth: st.PreviousBandwidth,
+			Events:            append([]RateEvent{}, st.Events...),
+		}
+		if !st.LastChange.IsZero() {
+			last := st.LastChange
+			ra.LastChange = &last
+		}
+		rep.RateAdjustments = ra
+	}
+}
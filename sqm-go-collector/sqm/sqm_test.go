@@ -0,0 +1,363 @@
+package sqm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Fail-Safe/netdata-chart-sqm/sqm-go-collector/tcstats"
+)
+
+func TestStateRatesAndResets(t *testing.T) {
+	sample := func(handle string, bytes uint64) Result {
+		return Result{Reports: []InterfaceReport{{
+			Interface:  "eth0",
+			Mode:       ModeCakeMQ,
+			RootHandle: handle,
+			Overview:   Overview{Bytes: bytes},
+			Queues: []QueueReport{{
+				QueueID: "root",
+				Handle:  handle,
+				Tins:    []TinMetrics{{Tin: "BE", SentBytes: bytes}},
+			}},
+		}}}
+	}
+
+	var state State
+	t0 := time.Unix(1700000000, 0)
+	steps := []struct {
+		handle    string
+		raw       uint64
+		wantTotal uint64
+		wantRate  float64
+	}{
+		{"1:", 1000, 1000, -1},
+		{"1:", 3000, 3000, 1000},
+		{"8001:", 500, 3500, 250},
+		{"8001:", 100, 3500, 0},
+	}
+	for i, step := range steps {
+		out := sample(step.handle, step.raw)
+		state.Observe(&out, t0.Add(time.Duration(2*i)*time.Second))
+		tin := out.Reports[0].Queues[0].Tins[0]
+		if tin.SentBytes != step.wantTotal || out.Reports[0].Overview.Bytes != step.wantTotal {
+			t.Fatalf("step %d: total = %d/%d, want %d", i, tin.SentBytes, out.Reports[0].Overview.Bytes, step.wantTotal)
+		}
+		if step.wantRate < 0 {
+			if tin.Rates != nil {
+				t.Fatalf("step %d: unexpected rates on first sample: %+v", i, *tin.Rates)
+			}
+			continue
+		}
+		if tin.Rates == nil || tin.Rates.SentBytes != step.wantRate {
+			t.Fatalf("step %d: rates = %+v, want sent_bytes %v", i, tin.Rates, step.wantRate)
+		}
+	}
+}
+
+func TestUtilisationFromRates(t *testing.T) {
+	in := Result{Reports: []InterfaceReport{{
+		Interface: "eth0",
+		Mode:      ModeCakeMQ,
+		Bandwidth: 1000,
+		Overview:  Overview{Rates: &OverviewRates{Bytes: 250}},
+		Queues: []QueueReport{{
+			QueueID: "all",
+			Tins:    []TinMetrics{{Tin: "BE", ThresholdRate: 400, Rates: &TinRates{SentBytes: 100}}},
+		}},
+	}}}
+	DeriveMetrics(&in)
+
+	if got := in.Reports[0].Overview.Rates.Utilisation; got != 25 {
+		t.Fatalf("link utilisation = %v, want 25", got)
+	}
+	if got := in.Reports[0].Queues[0].Tins[0].Rates.Utilisation; got != 25 {
+		t.Fatalf("tin utilisation = %v, want 25", got)
+	}
+}
+
+func TestCongestionRatios(t *testing.T) {
+	in := Result{Reports: []InterfaceReport{{
+		Interface: "eth0",
+		Mode:      ModeOverlay,
+		Overview:  Overview{Rates: &OverviewRates{}},
+		Queues: []QueueReport{{
+			QueueID:  "1",
+			Overview: Overview{Rates: &OverviewRates{}},
+			Tins: []TinMetrics{
+				{Tin: "BE", Rates: &TinRates{SentPackets: 990, Drops: 10, ECNMark: 99}},
+				{Tin: "VI", Rates: &TinRates{SentPackets: 1000}},
+			},
+		}},
+	}}}
+	DeriveMetrics(&in)
+
+	be := in.Reports[0].Queues[0].Tins[0].Rates
+	if be.DropRatio != 10 || be.ECNRatio != 100 || be.AckRatio != 0 {
+		t.Fatalf("unexpected tin ratios: %+v", *be)
+	}
+	if got := in.Reports[0].Queues[0].Overview.Rates.DropRatio; got != 5 {
+		t.Fatalf("queue drop ratio = %v, want 5", got)
+	}
+	if got := in.Reports[0].Overview.Rates.DropRatio; got != 5 {
+		t.Fatalf("interface drop ratio = %v, want 5", got)
+	}
+}
+
+func TestPacketSize(t *testing.T) {
+	in := Result{Reports: []InterfaceReport{{
+		Interface: "eth0",
+		Overview:  Overview{Rates: &OverviewRates{Bytes: 15000, Packets: 10}},
+		Queues: []QueueReport{{
+			QueueID: "all",
+			Tins:    []TinMetrics{{Tin: "BE", Rates: &TinRates{SentBytes: 600, SentPackets: 10}}},
+		}},
+	}}}
+	DeriveMetrics(&in)
+
+	if got := in.Reports[0].Overview.Rates.AvgPacketSize; got != 1500 {
+		t.Fatalf("overview packet size = %v, want 1500", got)
+	}
+	if got := in.Reports[0].Queues[0].Tins[0].Rates.AvgPacketSize; got != 60 {
+		t.Fatalf("tin packet size = %v, want 60", got)
+	}
+}
+
+func TestAggregateQueuesPolicies(t *testing.T) {
+	agg, err := ParseAggregation("peak=min,avg=byte-mean")
+	if err != nil {
+		t.Fatalf("ParseAggregation: %v", err)
+	}
+	if _, err := ParseAggregation("peak=median"); err == nil {
+		t.Fatalf("expected error for unknown policy")
+	}
+
+	root := tcstats.Qdisc{Kind: "cake_mq", Handle: "1:"}
+	children := []tcstats.Qdisc{
+		{Kind: "cake", Parent: "1:1", Options: tcstats.Options{Diffserv: "besteffort"}, Tins: []tcstats.Tin{{PeakDelayUS: 100, AvgDelayUS: 10, SentBytes: 3000}}},
+		{Kind: "cake", Parent: "1:2", Options: tcstats.Options{Diffserv: "besteffort"}, Tins: []tcstats.Tin{{PeakDelayUS: 900, AvgDelayUS: 50, SentBytes: 1000}}},
+	}
+	q := aggregateQueues(root, children, agg)
+	tin := q.Tins[0]
+	if tin.PeakDelayUS != 100 {
+		t.Fatalf("peak (min) = %d, want 100", tin.PeakDelayUS)
+	}
+	if tin.AvgDelayUS != 30 {
+		t.Fatalf("avg (byte-mean) without a previous sample = %d, want the plain mean 30", tin.AvgDelayUS)
+	}
+	if tin.Spread == nil || tin.Spread.PeakMinUS != 100 || tin.Spread.PeakMaxUS != 900 {
+		t.Fatalf("unexpected spread: %+v", tin.Spread)
+	}
+	if tin.SentBytes != 4000 {
+		t.Fatalf("sent bytes = %d, want 4000", tin.SentBytes)
+	}
+}
+
+func TestAggregateQueuesIntervalWeights(t *testing.T) {
+	agg, err := ParseAggregation("avg=byte-mean,base=packet-mean")
+	if err != nil {
+		t.Fatalf("ParseAggregation: %v", err)
+	}
+	root := tcstats.Qdisc{Kind: "cake_mq", Handle: "1:"}
+	sample := func(bytes1, bytes2, packets1, packets2 uint64) Result {
+		children := []tcstats.Qdisc{
+			{Kind: "cake", Handle: "10:", Parent: "1:1", Tins: []tcstats.Tin{{AvgDelayUS: 10, BaseDelayUS: 100, SentBytes: bytes1, SentPackets: packets1}}},
+			{Kind: "cake", Handle: "20:", Parent: "1:2", Tins: []tcstats.Tin{{AvgDelayUS: 50, BaseDelayUS: 500, SentBytes: bytes2, SentPackets: packets2}}},
+		}
+		return Result{Reports: []InterfaceReport{{Interface: "eth0", RootHandle: "1:", Queues: []QueueReport{aggregateQueues(root, children, agg)}}}}
+	}
+
+	// Queue 1 carried most traffic in the past but is nearly idle now.
+	state := NewState(0, 0)
+	now := time.Unix(1000, 0)
+	first := sample(1000000, 1000, 1000, 10)
+	state.Observe(&first, now)
+	if got := first.Reports[0].Queues[0].Tins[0].AvgDelayUS; got != 30 {
+		t.Fatalf("first avg = %d, want the plain mean 30", got)
+	}
+	second := sample(1000100, 1900, 1001, 19)
+	state.Observe(&second, now.Add(time.Second))
+	tin := second.Reports[0].Queues[0].Tins[0]
+	if tin.AvgDelayUS != 46 {
+		t.Fatalf("avg weighted by interval bytes = %d, want 46", tin.AvgDelayUS)
+	}
+	if tin.BaseDelayUS != 460 {
+		t.Fatalf("base weighted by interval packets = %d, want 460", tin.BaseDelayUS)
+	}
+	if tin.Spread == nil || tin.Spread.AvgMinUS != 10 || tin.Spread.AvgMaxUS != 50 {
+		t.Fatalf("unexpected spread: %+v", tin.Spread)
+	}
+}
+
+func TestQueueImbalance(t *testing.T) {
+	children := []tcstats.Qdisc{
+		{Kind: "cake", Handle: "10:", Parent: "1:1", Bytes: 3000, Tins: []tcstats.Tin{{PeakDelayUS: 100}}},
+		{Kind: "cake", Handle: "20:", Parent: "1:2", Bytes: 1000, Tins: []tcstats.Tin{{PeakDelayUS: 300}}},
+	}
+	im := imbalanceFromChildren("1:", children)
+	if im.Queues[0].Share != 75 || im.Queues[1].Share != 25 {
+		t.Fatalf("unexpected shares: %+v", im.Queues)
+	}
+	if im.ThroughputCV != 0.5 || im.BusiestQueue != "1" || im.PeakMaxOverMean != 1.5 {
+		t.Fatalf("unexpected imbalance summary: %+v", *im)
+	}
+
+	rate1, rate2 := 100.0, 300.0
+	im.Queues[0].BytesRate, im.Queues[1].BytesRate = &rate1, &rate2
+	im.compute()
+	if im.BusiestQueue != "2" || im.Queues[1].Share != 75 {
+		t.Fatalf("rates should take precedence over cumulative bytes: %+v", *im)
+	}
+	if n, ok := im.BusiestQueueNumber(); !ok || n != 2 {
+		t.Fatalf("busiest queue number = %d, %v; want 2", n, ok)
+	}
+
+	children = nil
+	for i := 1; i <= 12; i++ {
+		var bytes uint64 = 1000
+		if i == 10 {
+			bytes = 5000
+		}
+		children = append(children, tcstats.Qdisc{Kind: "cake", Handle: fmt.Sprintf("%x:", i+0x10), Parent: fmt.Sprintf("8001:%x", i), Bytes: bytes})
+	}
+	im = imbalanceFromChildren("8001:", children)
+	if im.BusiestQueue != "a" {
+		t.Fatalf("busiest queue = %q, want a", im.BusiestQueue)
+	}
+	if n, ok := im.BusiestQueueNumber(); !ok || n != 10 {
+		t.Fatalf("busiest queue number = %d, %v; want 10", n, ok)
+	}
+}
+
+func TestBufferbloatGrade(t *testing.T) {
+	sample := func(sent, avgUS uint64) Result {
+		return Result{Reports: []InterfaceReport{{
+			Interface:  "eth0",
+			RootHandle: "1:",
+			Queues: []QueueReport{{
+				QueueID: "root",
+				Handle:  "1:",
+				Tins:    []TinMetrics{{Tin: "BE", ThresholdRate: 1000, SentBytes: sent, AvgDelayUS: avgUS, PeakDelayUS: 2 * avgUS}},
+			}},
+		}}}
+	}
+
+	state := NewState(50, time.Minute)
+	t0 := time.Unix(1700000000, 0)
+	out := sample(0, 0)
+	state.Observe(&out, t0)
+
+	out = sample(900, 40000)
+	state.Observe(&out, t0.Add(time.Second))
+	bb := out.Reports[0].Bufferbloat
+	if bb == nil || !bb.Loaded || bb.Grade != "B" || bb.Score != 3 || bb.LatencyUS != 40000 {
+		t.Fatalf("unexpected grade after loaded interval: %+v", bb)
+	}
+
+	out = sample(910, 1000)
+	state.Observe(&out, t0.Add(2*time.Second))
+	bb = out.Reports[0].Bufferbloat
+	if bb == nil || bb.Loaded || bb.Grade != "B" {
+		t.Fatalf("idle interval should keep the last grade: %+v", bb)
+	}
+}
+
+func TestBloatGradeThresholds(t *testing.T) {
+	cases := map[float64]string{0: "A+", 4999: "A+", 5000: "A", 59999: "B", 199999: "C", 399999: "D", 400000: "F"}
+	for us, want := range cases {
+		if got, _ := bloatGrade(us); got != want {
+			t.Fatalf("bloatGrade(%v) = %s, want %s", us, got, want)
+		}
+	}
+}
+
+func TestLatencySamplerWindowStats(t *testing.T) {
+	sample := func(peak uint64) Result {
+		return Result{Reports: []InterfaceReport{{
+			Interface: "eth0",
+			Queues:    []QueueReport{{QueueID: "root", Tins: []TinMetrics{{Tin: "BE", PeakDelayUS: peak, AvgDelayUS: peak / 2}}}},
+		}}}
+	}
+
+	ls := NewLatencySampler()
+	for _, peak := range []uint64{400, 100, 300, 200, 1000} {
+		ls.Add(sample(peak))
+	}
+	out := sample(0)
+	ls.Attach(&out)
+
+	st := out.Reports[0].Queues[0].Tins[0].LatencyStats
+	if st == nil {
+		t.Fatalf("missing latency stats")
+	}
+	if st.Peak.MinUS != 100 || st.Peak.MaxUS != 1000 || st.Peak.MeanUS != 400 || st.Peak.P95US != 1000 || st.Peak.Samples != 5 {
+		t.Fatalf("unexpected peak window stats: %+v", st.Peak)
+	}
+
+	out = sample(0)
+	ls.Attach(&out)
+	if out.Reports[0].Queues[0].Tins[0].LatencyStats != nil {
+		t.Fatalf("Attach should start a new window")
+	}
+}
+
+func TestShaperRateAdjustments(t *testing.T) {
+	sample := func(bandwidth, thres uint64) Result {
+		return Result{Reports: []InterfaceReport{{
+			Interface:  "eth0",
+			RootHandle: "1:",
+			Bandwidth:  bandwidth,
+			Queues:     []QueueReport{{QueueID: "root", Handle: "1:", Tins: []TinMetrics{{Tin: "BE", ThresholdRate: thres}}}},
+		}}}
+	}
+
+	var state State
+	t0 := time.Unix(1700000000, 0)
+	for i, step := range []struct{ bandwidth, thres uint64 }{{1000, 900}, {1000, 900}, {2000, 1800}} {
+		out := sample(step.bandwidth, step.thres)
+		state.Observe(&out, t0.Add(time.Duration(i)*time.Second))
+		if i < 2 {
+			if ra := out.Reports[0].RateAdjustments; ra == nil || ra.Changes != 0 || ra.LastChange != nil {
+				t.Fatalf("step %d: unexpected adjustments %+v", i, ra)
+			}
+			continue
+		}
+		ra := out.Reports[0].RateAdjustments
+		if ra.Changes != 1 || ra.PreviousBandwidth != 1000 || ra.Bandwidth != 2000 || len(ra.Events) != 2 {
+			t.Fatalf("unexpected adjustments after change: %+v", ra)
+		}
+		if ra.Events[1].Target != "root/BE" || ra.Events[1].Previous != 900 || ra.Events[1].Current != 1800 {
+			t.Fatalf("unexpected tin event: %+v", ra.Events[1])
+		}
+	}
+}
+
+func TestCollectFromReplay(t *testing.T) {
+	dir := t.TempDir()
+	rec := `[
+  {"kind":"cake_mq","handle":"1:","root":true,"bytes":1000,"options":{"bandwidth":"unlimited"}},
+  {"kind":"cake","handle":"10:","parent":"1:1","bytes":600,"options":{"bandwidth":1000,"diffserv":"besteffort"},"tins":[{"sent_bytes":600,"peak_delay_us":100}]},
+  {"kind":"cake","handle":"20:","parent":"1:2","bytes":400,"options":{"bandwidth":3000,"diffserv":"besteffort"},"tins":[{"sent_bytes":400,"peak_delay_us":300}]},
+  {"kind":"ingress","handle":"ffff:","parent":"ffff:fff1"}
+]`
+	if err := os.WriteFile(filepath.Join(dir, "eth0.qdisc.json"), []byte(rec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := Collector{Source: tcstats.NewReplay(dir), Interfaces: []string{"eth0"}, Mode: ModeCakeMQ, Aggregation: DefaultAggregation}.Collect()
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	rep := out.Reports[0]
+	if rep.RootKind != "cake_mq" || rep.Bandwidth != 4000 || len(rep.Queues) != 1 {
+		t.Fatalf("unexpected report: %+v", rep)
+	}
+	if tin := rep.Queues[0].Tins[0]; tin.SentBytes != 1000 || tin.PeakDelayUS != 300 {
+		t.Fatalf("unexpected aggregated tin: %+v", tin)
+	}
+	if rep.Imbalance == nil || rep.Imbalance.BusiestQueue != "1" {
+		t.Fatalf("unexpected imbalance: %+v", rep.Imbalance)
+	}
+}
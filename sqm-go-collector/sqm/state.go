@@ -0,0 +1,240 @@
+package sqm
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// State carries the previous sample between collections: in memory in
+// daemon mode, or through -state-file for one-shot runs. Counters are rewritten
+// to monotonic totals so a recreated qdisc does not show up as a negative step
+// (and therefore a spike) on incremental Netdata dimensions.
+//
+// The exported map fields are the persisted form and should be treated as
+// opaque. Failures counts the consecutive failed collections of one-shot runs.
+// BloatLoadPct and BloatWindow configure the bufferbloat grade and are not
+// persisted.
+type State struct {
+	Time     time.Time              `json:"time"`
+	Handles  map[string]string      `json:"handles"`
+	Raw      map[string]uint64      `json:"raw"`
+	Total    map[string]uint64      `json:"total"`
+	Bloat    map[string]BloatState  `json:"bloat,omitempty"`
+	Shaper   map[string]ShaperState `json:"shaper,omitempty"`
+	Failures int                    `json:"failures,omitempty"`
+
+	BloatLoadPct float64       `json:"-"`
+	BloatWindow  time.Duration `json:"-"`
+}
+
+// TinRates holds the per-second rates of a tin and the metrics derived from
+// them.
+type TinRates struct {
+	SentBytes     float64 `json:"sent_bytes"`
+	SentPackets   float64 `json:"sent_packets"`
+	Drops         float64 `json:"drops"`
+	ECNMark       float64 `json:"ecn_mark"`
+	AckDrops      float64 `json:"ack_drops"`
+	AvgPacketSize float64 `json:"avg_packet_size"`
+	Utilisation   float64 `json:"utilisation_pct"`
+	DropRatio     float64 `json:"drop_ratio_permille"`
+	ECNRatio      float64 `json:"ecn_ratio_permille"`
+	AckRatio      float64 `json:"ack_ratio_permille"`
+}
+
+// OverviewRates holds the per-second rates of a qdisc and the metrics derived
+// from them. The congestion ratios are sums over the tins below it.
+type OverviewRates struct {
+	Bytes         float64 `json:"bytes"`
+	Packets       float64 `json:"packets"`
+	Drops         float64 `json:"drops"`
+	Overlimits    float64 `json:"overlimits"`
+	Requeues      float64 `json:"requeues"`
+	AvgPacketSize float64 `json:"avg_packet_size"`
+	Utilisation   float64 `json:"utilisation_pct"`
+	DropRatio     float64 `json:"drop_ratio_permille"`
+	ECNRatio      float64 `json:"ecn_ratio_permille"`
+	AckRatio      float64 `json:"ack_ratio_permille"`
+}
+
+// NewState returns an empty state with the given bufferbloat configuration.
+// Zero values select DefaultBloatLoadPct and DefaultBloatWindow.
+func NewState(bloatLoadPct float64, bloatWindow time.Duration) State {
+	return State{BloatLoadPct: bloatLoadPct, BloatWindow: bloatWindow}
+}
+
+// LoadState reads a state written by SaveState. A missing file yields an empty
+// state.
+func LoadState(path string) (State, error) {
+	var s State
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return State{}, err
+	}
+	return s, nil
+}
+
+// SaveState atomically replaces the file at path with s.
+func SaveState(path string, s State) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Observe rewrites the counters in out to monotonic totals, attaches per-second
+// rates and the metrics derived from them when a previous sample is known, and
+// replaces s with the new sample.
+//
+// A changed root or queue handle means the qdisc was recreated, so the raw value
+// is the traffic since then. A counter that decreases without a handle change
+// (e.g. one child of an aggregated cake_mq being recreated) has no known base
+// and contributes nothing for that interval.
+func (s *State) Observe(out *Result, now time.Time) {
+	next := State{
+		Time:    now,
+		Handles: make(map[string]string),
+		Raw:     make(map[string]uint64),
+		Total:   make(map[string]uint64),
+		Bloat:   make(map[string]BloatState),
+		Shaper:  make(map[string]ShaperState),
+
+		BloatLoadPct: s.BloatLoadPct,
+		BloatWindow:  s.BloatWindow,
+	}
+
+	dt := 0.0
+	if !s.Time.IsZero() {
+		dt = now.Sub(s.Time).Seconds()
+	}
+	if dt > 0 {
+		out.IntervalSeconds = dt
+	}
+
+	for ri := range out.Reports {
+		rep := &out.Reports[ri]
+		rootRecreated := s.handleChanged(rep.Interface, rep.RootHandle)
+		next.Handles[rep.Interface] = rep.RootHandle
+
+		counter := func(key string, recreated bool, v *uint64) (float64, bool) {
+			raw := *v
+			prevRaw, seen := s.Raw[key]
+			var delta uint64
+			switch {
+			case !seen:
+			case recreated:
+				delta = raw
+			case raw >= prevRaw:
+				delta = raw - prevRaw
+			}
+			total := raw
+			if seen {
+				total = s.Total[key] + delta
+			}
+			next.Raw[key] = raw
+			next.Total[key] = total
+			*v = total
+			if !seen || dt <= 0 {
+				return 0, false
+			}
+			return float64(delta) / dt, true
+		}
+
+		overviewCounters := func(prefix string, recreated bool, o *Overview) {
+			bytes, ok := counter(prefix+"/bytes", recreated, &o.Bytes)
+			packets, _ := counter(prefix+"/packets", recreated, &o.Packets)
+			drops, _ := counter(prefix+"/drops", recreated, &o.Drops)
+			overlimits, _ := counter(prefix+"/overlimits", recreated, &o.Overlimits)
+			requeues, _ := counter(prefix+"/requeues", recreated, &o.Requeues)
+			if ok {
+				o.Rates = &OverviewRates{Bytes: bytes, Packets: packets, Drops: drops, Overlimits: overlimits, Requeues: requeues}
+			}
+		}
+
+		overviewCounters(rep.Interface+"/overview", rootRecreated, &rep.Overview)
+		if im := rep.Imbalance; im != nil {
+			for li := range im.Queues {
+				ql := &im.Queues[li]
+				lkey := rep.Interface + "/imbalance/" + ql.QueueID
+				recreated := rootRecreated || s.handleChanged(lkey, ql.Handle)
+				next.Handles[lkey] = ql.Handle
+				if rate, ok := counter(lkey+"/bytes", recreated, &ql.Bytes); ok {
+					ql.BytesRate = &rate
+				}
+			}
+		}
+		for qi := range rep.Queues {
+			q := &rep.Queues[qi]
+			qkey := rep.Interface + "/" + q.QueueID
+			recreated := rootRecreated || s.handleChanged(qkey, q.Handle)
+			next.Handles[qkey] = q.Handle
+
+			overviewCounters(qkey+"/overview", recreated, &q.Overview)
+			for ti := range q.Tins {
+				tin := &q.Tins[ti]
+				tkey := qkey + "/" + tin.Tin
+				sent, ok := counter(tkey+"/sent_bytes", recreated, &tin.SentBytes)
+				packets, _ := counter(tkey+"/sent_packets", recreated, &tin.SentPackets)
+				drops, _ := counter(tkey+"/drops", recreated, &tin.Drops)
+				ecn, _ := counter(tkey+"/ecn_mark", recreated, &tin.ECNMark)
+				ack, _ := counter(tkey+"/ack_drops", recreated, &tin.AckDrops)
+				if ok {
+					tin.Rates = &TinRates{SentBytes: sent, SentPackets: packets, Drops: drops, ECNMark: ecn, AckDrops: ack}
+				}
+				if len(tin.children) > 0 {
+					weights := make([]childWeight, len(tin.children))
+					weighted := true
+					for ci, c := range tin.children {
+						ckey := tkey + "/child/" + c.queueID
+						childRecreated := recreated || s.handleChanged(ckey, c.handle)
+						next.Handles[ckey] = c.handle
+						bytes, ok := counter(ckey+"/sent_bytes", childRecreated, &c.sentBytes)
+						packets, _ := counter(ckey+"/sent_packets", childRecreated, &c.sentPackets)
+						weights[ci] = childWeight{bytes, packets}
+						weighted = weighted && ok
+					}
+					if weighted {
+						combineTin(tin, q.aggregation, tin.children, weights)
+					}
+				}
+			}
+		}
+	}
+
+	DeriveMetrics(out)
+	next.updateShaper(s.Shaper, out, now)
+	if dt > 0 {
+		next.updateBloat(s.Bloat, out, dt)
+	} else {
+		next.Bloat = s.Bloat
+	}
+	*s = next
+}
+
+func (s *State) handleChanged(key, handle string) bool {
+	prev, ok := s.Handles[key]
+	return ok && prev != handle
+}
@@ -0,0 +1,404 @@
+package tcstats
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Netlink reads qdiscs, classes and filters over an rtnetlink socket instead
+// of running tc, which saves a process per sample on small routers. It is
+// only available on Linux.
+type Netlink struct{}
+
+var errNetlinkUnsupported = errors.New("netlink source is only available on Linux")
+
+// Attribute types from linux/rtnetlink.h, linux/gen_stats.h and
+// linux/pkt_sched.h.
+const (
+	tcaKind    = 1
+	tcaOptions = 2
+	tcaStats2  = 7
+	tcaChain   = 11
+
+	tcaStatsBasic = 1
+	tcaStatsQueue = 3
+	tcaStatsApp   = 4
+	tcaStatsPkt64 = 8
+
+	tcaCakeBaseRate64   = 2
+	tcaCakeDiffservMode = 3
+	tcaCakeFlowMode     = 5
+	tcaCakeOverhead     = 6
+	tcaCakeRTT          = 7
+	tcaCakeNAT          = 11
+	tcaCakeWash         = 13
+	tcaCakeAckFilter    = 16
+
+	tcaCakeStatsTinStats = 10
+
+	tcaCakeTinStatsSentPackets        = 2
+	tcaCakeTinStatsSentBytes64        = 3
+	tcaCakeTinStatsDroppedPackets     = 4
+	tcaCakeTinStatsAcksDroppedPackets = 6
+	tcaCakeTinStatsECNMarkedPackets   = 8
+	tcaCakeTinStatsBacklogBytes       = 11
+	tcaCakeTinStatsThresholdRate64    = 12
+	tcaCakeTinStatsTargetUS           = 13
+	tcaCakeTinStatsPeakDelayUS        = 18
+	tcaCakeTinStatsAvgDelayUS         = 19
+	tcaCakeTinStatsBaseDelayUS        = 20
+	tcaCakeTinStatsSparseFlows        = 21
+	tcaCakeTinStatsBulkFlows          = 22
+	tcaCakeTinStatsUnresponsiveFlows  = 23
+
+	tcHRoot     = 0xFFFFFFFF
+	sizeofTcMsg = 20
+)
+
+// cakeDiffservModes maps CAKE_DIFFSERV_* to the names tc prints.
+var cakeDiffservModes = []string{"diffserv3", "diffserv4", "diffserv8", "besteffort", "precedence"}
+
+// cakeFlowModes and cakeAckFilters map CAKE_FLOW_* and CAKE_ACK_* to the
+// names tc prints.
+var (
+	cakeFlowModes  = []string{"flowblind", "srchost", "dsthost", "hosts", "flows", "dual-srchost", "dual-dsthost", "triple-isolate"}
+	cakeAckFilters = []string{"disabled", "ack-filter", "ack-filter-aggressive"}
+)
+
+type nlAttr struct {
+	typ  uint16
+	data []byte
+}
+
+// parseAttrs splits a buffer of rtattrs. The nested and byte-order flags are
+// masked off the type.
+func parseAttrs(b []byte) ([]nlAttr, error) {
+	var attrs []nlAttr
+	for len(b) >= 4 {
+		l := int(binary.NativeEndian.Uint16(b[0:2]))
+		if l < 4 || l > len(b) {
+			return nil, fmt.Errorf("malformed netlink attribute (length %d of %d)", l, len(b))
+		}
+		attrs = append(attrs, nlAttr{typ: binary.NativeEndian.Uint16(b[2:4]) & 0x3fff, data: b[4:l]})
+		l = (l + 3) &^ 3
+		if l > len(b) {
+			break
+		}
+		b = b[l:]
+	}
+	return attrs, nil
+}
+
+// attrUint reads an unsigned attribute of 1, 2, 4 or 8 bytes.
+func attrUint(b []byte) uint64 {
+	switch len(b) {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(binary.NativeEndian.Uint16(b))
+	case 4:
+		return uint64(binary.NativeEndian.Uint32(b))
+	case 8:
+		return binary.NativeEndian.Uint64(b)
+	}
+	return 0
+}
+
+type tcMsg struct {
+	ifindex int32
+	handle  uint32
+	parent  uint32
+	info    uint32
+	attrs   []nlAttr
+}
+
+func parseTcMsg(b []byte) (tcMsg, error) {
+	if len(b) < sizeofTcMsg {
+		return tcMsg{}, errors.New("short tcmsg")
+	}
+	m := tcMsg{
+		ifindex: int32(binary.NativeEndian.Uint32(b[4:8])),
+		handle:  binary.NativeEndian.Uint32(b[8:12]),
+		parent:  binary.NativeEndian.Uint32(b[12:16]),
+		info:    binary.NativeEndian.Uint32(b[16:20]),
+	}
+	attrs, err := parseAttrs(b[sizeofTcMsg:])
+	m.attrs = attrs
+	return m, err
+}
+
+func (m tcMsg) kind() string {
+	for _, a := range m.attrs {
+		if a.typ == tcaKind {
+			return strings.TrimRight(string(a.data), "\x00")
+		}
+	}
+	return ""
+}
+
+// formatHandle prints a handle the way tc does.
+func formatHandle(h uint32) string {
+	switch {
+	case h == tcHRoot:
+		return "root"
+	case h == 0:
+		return "none"
+	case h>>16 == 0:
+		return fmt.Sprintf(":%x", h&0xffff)
+	case h&0xffff == 0:
+		return fmt.Sprintf("%x:", h>>16)
+	default:
+		return fmt.Sprintf("%x:%x", h>>16, h&0xffff)
+	}
+}
+
+// counters holds the generic statistics of a qdisc or class.
+type counters struct {
+	bytes, packets, drops, overlimits, requeues, backlog, qlen uint64
+	app                                                        []byte
+}
+
+func parseStats2(b []byte) (counters, error) {
+	var c counters
+	attrs, err := parseAttrs(b)
+	if err != nil {
+		return c, err
+	}
+	var pkt64 bool
+	for _, a := range attrs {
+		switch a.typ {
+		case tcaStatsBasic:
+			// struct gnet_stats_basic { __u64 bytes; __u32 packets; }
+			if len(a.data) >= 12 {
+				c.bytes = binary.NativeEndian.Uint64(a.data[0:8])
+				if !pkt64 {
+					c.packets = uint64(binary.NativeEndian.Uint32(a.data[8:12]))
+				}
+			}
+		case tcaStatsPkt64:
+			c.packets, pkt64 = attrUint(a.data), true
+		case tcaStatsQueue:
+			// struct gnet_stats_queue { qlen, backlog, drops, requeues, overlimits }
+			if len(a.data) >= 20 {
+				c.qlen = uint64(binary.NativeEndian.Uint32(a.data[0:4]))
+				c.backlog = uint64(binary.NativeEndian.Uint32(a.data[4:8]))
+				c.drops = uint64(binary.NativeEndian.Uint32(a.data[8:12]))
+				c.requeues = uint64(binary.NativeEndian.Uint32(a.data[12:16]))
+				c.overlimits = uint64(binary.NativeEndian.Uint32(a.data[16:20]))
+			}
+		case tcaStatsApp:
+			c.app = a.data
+		}
+	}
+	return c, nil
+}
+
+func (m tcMsg) counters() (counters, error) {
+	for _, a := range m.attrs {
+		if a.typ == tcaStats2 {
+			return parseStats2(a.data)
+		}
+	}
+	return counters{}, nil
+}
+
+func decodeQdiscMsg(b []byte) (int32, Qdisc, error) {
+	m, err := parseTcMsg(b)
+	if err != nil {
+		return 0, Qdisc{}, err
+	}
+	q := Qdisc{Kind: m.kind(), Handle: fmt.Sprintf("%x:", m.handle>>16)}
+	if m.parent == tcHRoot {
+		q.Root = true
+	} else {
+		q.Parent = formatHandle(m.parent)
+	}
+	c, err := m.counters()
+	if err != nil {
+		return 0, Qdisc{}, err
+	}
+	q.Bytes, q.Packets, q.Drops = c.bytes, c.packets, c.drops
+	q.Overlimits, q.Requeues, q.Backlog, q.Qlen = c.overlimits, c.requeues, c.backlog, c.qlen
+
+	if q.Kind == "cake" || q.Kind == "cake_mq" {
+		for _, a := range m.attrs {
+			if a.typ == tcaOptions {
+				if q.Options, err = parseCakeOptions(a.data); err != nil {
+					return 0, Qdisc{}, err
+				}
+			}
+		}
+		if c.app != nil {
+			if q.Tins, err = parseCakeTins(c.app); err != nil {
+				return 0, Qdisc{}, err
+			}
+		}
+	}
+	return m.ifindex, q, nil
+}
+
+func parseCakeOptions(b []byte) (Options, error) {
+	var o Options
+	attrs, err := parseAttrs(b)
+	if err != nil {
+		return o, err
+	}
+	for _, a := range attrs {
+		switch a.typ {
+		case tcaCakeBaseRate64:
+			o.Bandwidth = Rate(attrUint(a.data))
+		case tcaCakeDiffservMode:
+			if mode := attrUint(a.data); mode < uint64(len(cakeDiffservModes)) {
+				o.Diffserv = cakeDiffservModes[mode]
+			}
+		case tcaCakeFlowMode:
+			if mode := attrUint(a.data); mode < uint64(len(cakeFlowModes)) {
+				o.FlowMode = cakeFlowModes[mode]
+			}
+		case tcaCakeOverhead:
+			o.Overhead = int(int32(attrUint(a.data)))
+		case tcaCakeRTT:
+			o.RTT = attrUint(a.data)
+		case tcaCakeNAT:
+			o.NAT = attrUint(a.data) != 0
+		case tcaCakeWash:
+			o.Wash = attrUint(a.data) != 0
+		case tcaCakeAckFilter:
+			if mode := attrUint(a.data); mode < uint64(len(cakeAckFilters)) {
+				o.AckFilter = cakeAckFilters[mode]
+			}
+		}
+	}
+	return o, nil
+}
+
+// parseCakeTins reads TCA_CAKE_STATS_TIN_STATS from the CAKE xstats. Each tin
+// is a nested attribute whose type is its index plus one.
+func parseCakeTins(b []byte) ([]Tin, error) {
+	stats, err := parseAttrs(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range stats {
+		if s.typ != tcaCakeStatsTinStats {
+			continue
+		}
+		tinAttrs, err := parseAttrs(s.data)
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(tinAttrs, func(i, j int) bool { return tinAttrs[i].typ < tinAttrs[j].typ })
+		tins := make([]Tin, 0, len(tinAttrs))
+		for _, ta := range tinAttrs {
+			attrs, err := parseAttrs(ta.data)
+			if err != nil {
+				return nil, err
+			}
+			var t Tin
+			for _, a := range attrs {
+				v := attrUint(a.data)
+				switch a.typ {
+				case tcaCakeTinStatsSentPackets:
+					t.SentPackets = v
+				case tcaCakeTinStatsSentBytes64:
+					t.SentBytes = v
+				case tcaCakeTinStatsDroppedPackets:
+					t.Drops = v
+				case tcaCakeTinStatsAcksDroppedPackets:
+					t.AckDrops = v
+				case tcaCakeTinStatsECNMarkedPackets:
+					t.ECNMark = v
+				case tcaCakeTinStatsBacklogBytes:
+					t.BacklogBytes = v
+				case tcaCakeTinStatsThresholdRate64:
+					t.ThresholdRate = v
+				case tcaCakeTinStatsTargetUS:
+					t.TargetUS = v
+				case tcaCakeTinStatsPeakDelayUS:
+					t.PeakDelayUS = v
+				case tcaCakeTinStatsAvgDelayUS:
+					t.AvgDelayUS = v
+				case tcaCakeTinStatsBaseDelayUS:
+					t.BaseDelayUS = v
+				case tcaCakeTinStatsSparseFlows:
+					t.SparseFlows = v
+				case tcaCakeTinStatsBulkFlows:
+					t.BulkFlows = v
+				case tcaCakeTinStatsUnresponsiveFlows:
+					t.UnresponsiveFlows = v
+				}
+			}
+			tins = append(tins, t)
+		}
+		return tins, nil
+	}
+	return nil, nil
+}
+
+func decodeClassMsg(b []byte) (Class, error) {
+	m, err := parseTcMsg(b)
+	if err != nil {
+		return Class{}, err
+	}
+	cl := Class{Kind: m.kind(), Handle: formatHandle(m.handle)}
+	if m.parent == tcHRoot {
+		cl.Root = true
+	} else {
+		cl.Parent = formatHandle(m.parent)
+	}
+	if m.info != 0 {
+		cl.Leaf = fmt.Sprintf("%x:", m.info>>16)
+	}
+	c, err := m.counters()
+	if err != nil {
+		return Class{}, err
+	}
+	cl.Bytes, cl.Packets, cl.Drops = c.bytes, c.packets, c.drops
+	cl.Overlimits, cl.Requeues, cl.Backlog, cl.Qlen = c.overlimits, c.requeues, c.backlog, c.qlen
+	return cl, nil
+}
+
+func decodeFilterMsg(b []byte) (Filter, error) {
+	m, err := parseTcMsg(b)
+	if err != nil {
+		return Filter{}, err
+	}
+	f := Filter{
+		Parent:   formatHandle(m.parent),
+		Protocol: protocolName(uint16(m.info)),
+		Pref:     m.info >> 16,
+		Kind:     m.kind(),
+	}
+	for _, a := range m.attrs {
+		if a.typ == tcaChain {
+			f.Chain = uint32(attrUint(a.data))
+		}
+	}
+	return f, nil
+}
+
+// protocolName names the ethertype of a filter, which the kernel keeps in
+// network byte order in the low half of tcm_info.
+func protocolName(raw uint16) string {
+	var b [2]byte
+	binary.NativeEndian.PutUint16(b[:], raw)
+	switch p := binary.BigEndian.Uint16(b[:]); p {
+	case 0x0003:
+		return "all"
+	case 0x0800:
+		return "ip"
+	case 0x0806:
+		return "arp"
+	case 0x86dd:
+		return "ipv6"
+	case 0x8100:
+		return "802.1Q"
+	case 0x88a8:
+		return "802.1ad"
+	default:
+		return fmt.Sprintf("0x%04x", p)
+	}
+}
@@ -0,0 +1,125 @@
+//go:build linux
+
+package tcstats
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Qdiscs dumps the qdiscs of all interfaces and keeps those of ifc.
+func (Netlink) Qdiscs(ifc string) ([]Qdisc, error) {
+	idx, err := ifindex(ifc)
+	if err != nil {
+		return nil, err
+	}
+	qdiscs := make([]Qdisc, 0)
+	err = netlinkDump(syscall.RTM_GETQDISC, idx, func(b []byte) error {
+		msgIdx, q, err := decodeQdiscMsg(b)
+		if err == nil && msgIdx == idx {
+			qdiscs = append(qdiscs, q)
+		}
+		return err
+	})
+	return qdiscs, err
+}
+
+// Classes dumps the classes of ifc.
+func (Netlink) Classes(ifc string) ([]Class, error) {
+	idx, err := ifindex(ifc)
+	if err != nil {
+		return nil, err
+	}
+	classes := make([]Class, 0)
+	err = netlinkDump(syscall.RTM_GETTCLASS, idx, func(b []byte) error {
+		c, err := decodeClassMsg(b)
+		if err == nil {
+			classes = append(classes, c)
+		}
+		return err
+	})
+	return classes, err
+}
+
+// Filters dumps the filters of the root qdisc of ifc and its classes.
+func (Netlink) Filters(ifc string) ([]Filter, error) {
+	idx, err := ifindex(ifc)
+	if err != nil {
+		return nil, err
+	}
+	filters := make([]Filter, 0)
+	err = netlinkDump(syscall.RTM_GETTFILTER, idx, func(b []byte) error {
+		f, err := decodeFilterMsg(b)
+		if err == nil {
+			filters = append(filters, f)
+		}
+		return err
+	})
+	return filters, err
+}
+
+func ifindex(ifc string) (int32, error) {
+	iface, err := net.InterfaceByName(ifc)
+	if err != nil {
+		return 0, err
+	}
+	return int32(iface.Index), nil
+}
+
+// netlinkDump sends a dump request with a tcmsg for ifindex and passes the
+// payload of every reply message to fn.
+func netlinkDump(msgType uint16, idx int32, fn func([]byte) error) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("netlink socket: %w", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("netlink bind: %w", err)
+	}
+
+	const seq = 1
+	req := make([]byte, syscall.NLMSG_HDRLEN+sizeofTcMsg)
+	binary.NativeEndian.PutUint32(req[0:4], uint32(len(req)))
+	binary.NativeEndian.PutUint16(req[4:6], msgType)
+	binary.NativeEndian.PutUint16(req[6:8], syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+	binary.NativeEndian.PutUint32(req[8:12], seq)
+	req[syscall.NLMSG_HDRLEN] = syscall.AF_UNSPEC
+	binary.NativeEndian.PutUint32(req[syscall.NLMSG_HDRLEN+4:], uint32(idx))
+	if err := syscall.Sendto(fd, req, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("netlink send: %w", err)
+	}
+
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return fmt.Errorf("netlink receive: %w", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return fmt.Errorf("netlink parse: %w", err)
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) >= 4 {
+					if errno := int32(binary.NativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+						return fmt.Errorf("netlink: %w", syscall.Errno(-errno))
+					}
+				}
+				return nil
+			}
+			if err := fn(m.Data); err != nil {
+				return err
+			}
+		}
+	}
+}
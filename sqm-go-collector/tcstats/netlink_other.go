@@ -0,0 +1,12 @@
+//go:build !linux
+
+package tcstats
+
+// Qdiscs is not supported on this platform.
+func (Netlink) Qdiscs(ifc string) ([]Qdisc, error) { return nil, errNetlinkUnsupported }
+
+// Classes is not supported on this platform.
+func (Netlink) Classes(ifc string) ([]Class, error) { return nil, errNetlinkUnsupported }
+
+// Filters is not supported on this platform.
+func (Netlink) Filters(ifc string) ([]Filter, error) { return nil, errNetlinkUnsupported }
@@ -0,0 +1,268 @@
+package tcstats
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Source lists the traffic control objects of an interface.
+type Source interface {
+	// Qdiscs returns every qdisc of ifc, like "tc -s qdisc show dev <ifc>".
+	Qdiscs(ifc string) ([]Qdisc, error)
+	// Classes returns the classes of ifc, like "tc -s class show dev <ifc>".
+	Classes(ifc string) ([]Class, error)
+	// Filters returns the filters attached to the root qdisc of ifc and its
+	// classes, like "tc filter show dev <ifc>".
+	Filters(ifc string) ([]Filter, error)
+}
+
+// RawSource is implemented by sources that can return the unmodified tc JSON
+// they decode. Netlink has no tc output and does not implement it.
+type RawSource interface {
+	// Raw returns the JSON of "tc -s -j <object> show dev <ifc>" as printed
+	// by tc, for object qdisc, class or filter.
+	Raw(object, ifc string) (json.RawMessage, error)
+}
+
+// ParseSource returns the source selected by spec:
+//
+//	tc             run tc from PATH (also the empty spec)
+//	netlink        query the kernel over rtnetlink (Linux only)
+//	replay:<dir>   serve files recorded in dir, see Replay
+//	remote:<cmd>   run tc through cmd, e.g. "remote:ssh -T root@router"
+func ParseSource(spec string) (Source, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "", "tc":
+		if arg != "" {
+			break
+		}
+		return Exec{}, nil
+	case "netlink":
+		if arg != "" {
+			break
+		}
+		return Netlink{}, nil
+	case "replay":
+		if arg == "" {
+			return nil, errors.New("replay source needs a directory (replay:<dir>)")
+		}
+		return NewReplay(arg), nil
+	case "remote":
+		cmd := strings.Fields(arg)
+		if len(cmd) == 0 {
+			return nil, errors.New("remote source needs a command (remote:<cmd>)")
+		}
+		return Exec{Command: append(cmd, "tc"), Quote: true}, nil
+	}
+	return nil, fmt.Errorf("invalid source %q (expected tc|netlink|replay:<dir>|remote:<cmd>)", spec)
+}
+
+// Exec runs tc and decodes its JSON output.
+type Exec struct {
+	// Command is the tc invocation; nil runs "tc" from PATH. A remote executor
+	// prefixes it with a wrapper, e.g. {"ssh", "-T", "root@router", "tc"}.
+	Command []string
+	// Quote shell-quotes the tc arguments, for wrappers such as ssh that join
+	// them into a command line for a remote shell.
+	Quote bool
+}
+
+// execArgs holds the tc arguments of each object kind, ending before the
+// interface name.
+var execArgs = map[string][]string{
+	"qdisc":  {"-s", "-j", "qdisc", "show", "dev"},
+	"class":  {"-s", "-j", "class", "show", "dev"},
+	"filter": {"-j", "filter", "show", "dev"},
+}
+
+// Raw returns the output of tc for object (qdisc, class or filter) on ifc.
+func (e Exec) Raw(object, ifc string) (json.RawMessage, error) {
+	args, ok := execArgs[object]
+	if !ok {
+		return nil, fmt.Errorf("invalid tc object %q (expected qdisc|class|filter)", object)
+	}
+	out, err := e.run(append(args[:len(args):len(args)], ifc)...)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(out) {
+		return nil, errors.New("tc printed invalid JSON")
+	}
+	return json.RawMessage(out), nil
+}
+
+// Qdiscs runs "tc -s -j qdisc show dev <ifc>".
+func (e Exec) Qdiscs(ifc string) ([]Qdisc, error) {
+	out, err := e.Raw("qdisc", ifc)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(out)
+}
+
+// Classes runs "tc -s -j class show dev <ifc>".
+func (e Exec) Classes(ifc string) ([]Class, error) {
+	out, err := e.Raw("class", ifc)
+	if err != nil {
+		return nil, err
+	}
+	var classes []Class
+	if err := json.Unmarshal(out, &classes); err != nil {
+		return nil, err
+	}
+	return classes, nil
+}
+
+// Filters runs "tc -j filter show dev <ifc>".
+func (e Exec) Filters(ifc string) ([]Filter, error) {
+	out, err := e.Raw("filter", ifc)
+	if err != nil {
+		return nil, err
+	}
+	var filters []Filter
+	if err := json.Unmarshal(out, &filters); err != nil {
+		return nil, err
+	}
+	return filters, nil
+}
+
+func (e Exec) run(args ...string) ([]byte, error) {
+	command := e.Command
+	if len(command) == 0 {
+		command = []string{"tc"}
+	}
+	if e.Quote {
+		quoted := make([]string, len(args))
+		for i, a := range args {
+			quoted[i] = shellQuote(a)
+		}
+		args = quoted
+	}
+	cmd := exec.Command(command[0], append(command[1:len(command):len(command)], args...)...)
+	out, err := cmd.Output()
+	if err != nil {
+		if ee := new(exec.ExitError); errors.As(err, &ee) {
+			return nil, fmt.Errorf("tc failed: %s", strings.TrimSpace(string(ee.Stderr)))
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// shellQuote quotes s for a POSIX shell unless it only holds characters that
+// need no quoting.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-.,:/@=+") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Replay serves tc output recorded in a directory, for tests and offline
+// analysis. <ifc>.qdisc.json holds the output of "tc -s -j qdisc show dev
+// <ifc>"; <ifc>.class.json and <ifc>.filter.json are optional and default to
+// empty lists. A file may hold several recordings one after another (e.g. one
+// per line): each call returns the next one and the last one repeats.
+type Replay struct {
+	Dir string
+
+	mu   sync.Mutex
+	next map[string]int
+}
+
+// NewReplay returns a replay source reading from dir.
+func NewReplay(dir string) *Replay {
+	return &Replay{Dir: dir, next: make(map[string]int)}
+}
+
+// Qdiscs returns the next recording of <ifc>.qdisc.json.
+func (r *Replay) Qdiscs(ifc string) ([]Qdisc, error) {
+	var qdiscs []Qdisc
+	return qdiscs, r.read(ifc+".qdisc.json", false, &qdiscs)
+}
+
+// Classes returns the next recording of <ifc>.class.json.
+func (r *Replay) Classes(ifc string) ([]Class, error) {
+	classes := []Class{}
+	return classes, r.read(ifc+".class.json", true, &classes)
+}
+
+// Filters returns the next recording of <ifc>.filter.json.
+func (r *Replay) Filters(ifc string) ([]Filter, error) {
+	filters := []Filter{}
+	return filters, r.read(ifc+".filter.json", true, &filters)
+}
+
+// Raw returns the recording of <ifc>.<object>.json that was served last (the
+// first one before any), as recorded. Missing class and filter files yield an
+// empty list.
+func (r *Replay) Raw(object, ifc string) (json.RawMessage, error) {
+	if _, ok := execArgs[object]; !ok {
+		return nil, fmt.Errorf("invalid tc object %q (expected qdisc|class|filter)", object)
+	}
+	name := ifc + "." + object + ".json"
+	recs, err := r.recordings(name)
+	if object != "qdisc" && errors.Is(err, os.ErrNotExist) {
+		return json.RawMessage("[]"), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return recs[min(max(r.next[name]-1, 0), len(recs)-1)], nil
+}
+
+func (r *Replay) read(name string, optional bool, v any) error {
+	recs, err := r.recordings(name)
+	if optional && errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.next == nil {
+		r.next = make(map[string]int)
+	}
+	i := min(r.next[name], len(recs)-1)
+	r.next[name] = i + 1
+	return json.Unmarshal(recs[i], v)
+}
+
+// recordings returns the JSON documents of the file name in r.Dir.
+func (r *Replay) recordings(name string) ([]json.RawMessage, error) {
+	f, err := os.Open(filepath.Join(r.Dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var recs []json.RawMessage
+	dec := json.NewDecoder(f)
+	for {
+		var rec json.RawMessage
+		err := dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) == 0 {
+		return nil, fmt.Errorf("%s: no recordings", name)
+	}
+	return recs, nil
+}
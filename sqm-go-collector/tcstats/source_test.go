@@ -0,0 +1,168 @@
+package tcstats
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSource(t *testing.T) {
+	for spec, want := range map[string]string{"": "tc", "tc": "tc", "netlink": "netlink", "replay:/tmp/rec": "replay", "remote:ssh -T root@router": "remote"} {
+		src, err := ParseSource(spec)
+		if err != nil {
+			t.Fatalf("ParseSource(%q): %v", spec, err)
+		}
+		var got string
+		switch s := src.(type) {
+		case Exec:
+			got = "tc"
+			if len(s.Command) > 0 {
+				got = "remote"
+				if s.Command[0] != "ssh" || s.Command[len(s.Command)-1] != "tc" || !s.Quote {
+					t.Fatalf("remote command = %v", s.Command)
+				}
+			}
+		case Netlink:
+			got = "netlink"
+		case *Replay:
+			got = "replay"
+		}
+		if got != want {
+			t.Fatalf("ParseSource(%q) = %T, want %s", spec, src, want)
+		}
+	}
+	for _, spec := range []string{"bogus", "replay:", "remote:", "tc:x"} {
+		if _, err := ParseSource(spec); err == nil {
+			t.Fatalf("ParseSource(%q): expected error", spec)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for in, want := range map[string]string{
+		"eth0":        "eth0",
+		"ifb4eth0.10": "ifb4eth0.10",
+		"-s":          "-s",
+		"eth0;reboot": "'eth0;reboot'",
+		"a b":         "'a b'",
+		"it's":        `'it'\''s'`,
+		"":            "''",
+	} {
+		if got := shellQuote(in); got != want {
+			t.Fatalf("shellQuote(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestReplaySequence(t *testing.T) {
+	dir := t.TempDir()
+	rec := `[{"kind":"cake","handle":"1:","root":true,"bytes":100}]
+[{"kind":"cake","handle":"1:","root":true,"bytes":200}]
+`
+	if err := os.WriteFile(filepath.Join(dir, "eth0.qdisc.json"), []byte(rec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReplay(dir)
+	for i, want := range []uint64{100, 200, 200} {
+		qdiscs, err := r.Qdiscs("eth0")
+		if err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+		if root, ok := Root(qdiscs); !ok || root.Bytes != want {
+			t.Fatalf("call %d: root = %+v, want bytes %d", i, root, want)
+		}
+	}
+	if classes, err := r.Classes("eth0"); err != nil || len(classes) != 0 {
+		t.Fatalf("missing class file should be empty: %v, %v", classes, err)
+	}
+	if _, err := r.Qdiscs("eth1"); err == nil {
+		t.Fatalf("expected error for missing qdisc file")
+	}
+}
+
+func nlattr(typ uint16, data []byte) []byte {
+	b := make([]byte, 4, 4+len(data)+3)
+	binary.NativeEndian.PutUint16(b[0:2], uint16(4+len(data)))
+	binary.NativeEndian.PutUint16(b[2:4], typ)
+	b = append(b, data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func u32(v uint32) []byte { return binary.NativeEndian.AppendUint32(nil, v) }
+func u64(v uint64) []byte { return binary.NativeEndian.AppendUint64(nil, v) }
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func TestDecodeCakeNetlinkMessage(t *testing.T) {
+	tcm := make([]byte, sizeofTcMsg)
+	binary.NativeEndian.PutUint32(tcm[4:8], 3)
+	binary.NativeEndian.PutUint32(tcm[8:12], 0x80010000)
+	binary.NativeEndian.PutUint32(tcm[12:16], 0x00010002)
+
+	basic := concat(u64(5000), u32(40), u32(0))
+	queue := concat(u32(2), u32(300), u32(7), u32(1), u32(9))
+	tin := func(sent uint64, peak uint32) []byte {
+		return concat(
+			nlattr(tcaCakeTinStatsSentBytes64, u64(sent)),
+			nlattr(tcaCakeTinStatsSentPackets, u32(10)),
+			nlattr(tcaCakeTinStatsThresholdRate64, u64(125000)),
+			nlattr(tcaCakeTinStatsPeakDelayUS, u32(peak)),
+			nlattr(tcaCakeTinStatsBulkFlows, u32(2)),
+		)
+	}
+	app := nlattr(tcaCakeStatsTinStats|0x8000, concat(
+		nlattr(2|0x8000, tin(2000, 900)),
+		nlattr(1|0x8000, tin(1000, 100)),
+	))
+	msg := concat(tcm,
+		nlattr(tcaKind, []byte("cake\x00")),
+		nlattr(tcaOptions|0x8000, concat(
+			nlattr(tcaCakeBaseRate64, u64(1250000)),
+			nlattr(tcaCakeDiffservMode, u32(3)),
+			nlattr(tcaCakeFlowMode, u32(7)),
+			nlattr(tcaCakeOverhead, u32(0xffffffff)),
+			nlattr(tcaCakeRTT, u32(100000)),
+			nlattr(tcaCakeNAT, u32(1)),
+			nlattr(tcaCakeAckFilter, u32(2)),
+		)),
+		nlattr(tcaStats2|0x8000, concat(nlattr(tcaStatsBasic, basic), nlattr(tcaStatsQueue, queue), nlattr(tcaStatsApp, app))),
+	)
+
+	idx, q, err := decodeQdiscMsg(msg)
+	if err != nil {
+		t.Fatalf("decodeQdiscMsg: %v", err)
+	}
+	if idx != 3 || q.Kind != "cake" || q.Handle != "8001:" || q.Parent != "1:2" || q.Root {
+		t.Fatalf("unexpected header fields: %d %+v", idx, q)
+	}
+	want := Options{Bandwidth: 1250000, Diffserv: "besteffort", FlowMode: "triple-isolate", Overhead: -1, RTT: 100000, NAT: true, AckFilter: "ack-filter-aggressive"}
+	if q.Options != want {
+		t.Fatalf("unexpected options: %+v", q.Options)
+	}
+	if q.Bytes != 5000 || q.Packets != 40 || q.Qlen != 2 || q.Backlog != 300 || q.Drops != 7 || q.Requeues != 1 || q.Overlimits != 9 {
+		t.Fatalf("unexpected counters: %+v", q)
+	}
+	if len(q.Tins) != 2 || q.Tins[0].SentBytes != 1000 || q.Tins[1].PeakDelayUS != 900 || q.Tins[1].ThresholdRate != 125000 || q.Tins[0].BulkFlows != 2 {
+		t.Fatalf("unexpected tins: %+v", q.Tins)
+	}
+}
+
+func TestFormatHandle(t *testing.T) {
+	cases := map[uint32]string{tcHRoot: "root", 0: "none", 0x10000: "1:", 0x10001: "1:1", 0xfffffff1: "ffff:fff1", 5: ":5"}
+	for h, want := range cases {
+		if got := formatHandle(h); got != want {
+			t.Fatalf("formatHandle(%#x) = %q, want %q", h, got, want)
+		}
+	}
+}
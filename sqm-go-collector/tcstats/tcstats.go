@@ -0,0 +1,147 @@
+// Package tcstats reads traffic control statistics for the qdiscs used by SQM
+// setups (cake, cake_mq, mq and fq_codel). The types follow the JSON printed by
+// "tc -s -j"; a Source provides them from tc, netlink or recorded files.
+package tcstats
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Options holds the qdisc options the collector uses. RTT is in
+// microseconds and Overhead in bytes per packet.
+type Options struct {
+	Bandwidth Rate   `json:"bandwidth"`
+	Diffserv  string `json:"diffserv"`
+	FlowMode  string `json:"flowmode,omitempty"`
+	RTT       uint64 `json:"rtt,omitempty"`
+	Overhead  int    `json:"overhead,omitempty"`
+	NAT       bool   `json:"nat,omitempty"`
+	Wash      bool   `json:"wash,omitempty"`
+	AckFilter string `json:"ack-filter,omitempty"`
+}
+
+// Summary returns the CAKE options besides bandwidth and diffserv the way tc
+// prints them, e.g. "triple-isolate nat rtt 100ms".
+func (o Options) Summary() string {
+	var parts []string
+	if o.FlowMode != "" {
+		parts = append(parts, o.FlowMode)
+	}
+	if o.NAT {
+		parts = append(parts, "nat")
+	}
+	if o.Wash {
+		parts = append(parts, "wash")
+	}
+	if o.AckFilter != "" && o.AckFilter != "disabled" {
+		parts = append(parts, o.AckFilter)
+	}
+	if o.RTT > 0 {
+		parts = append(parts, "rtt "+strconv.FormatFloat(float64(o.RTT)/1000, 'f', -1, 64)+"ms")
+	}
+	if o.Overhead != 0 {
+		parts = append(parts, "overhead "+strconv.Itoa(o.Overhead))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Rate is a rate in bytes per second. tc reports an unshaped cake as
+// "bandwidth": "unlimited", which decodes as zero.
+type Rate uint64
+
+// UnmarshalJSON decodes a numeric rate, or any string as zero.
+func (r *Rate) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		*r = 0
+		return nil
+	}
+	var v uint64
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*r = Rate(v)
+	return nil
+}
+
+// Tin holds the statistics of one CAKE tin.
+type Tin struct {
+	ThresholdRate     uint64 `json:"threshold_rate"`
+	SentBytes         uint64 `json:"sent_bytes"`
+	BacklogBytes      uint64 `json:"backlog_bytes"`
+	TargetUS          uint64 `json:"target_us"`
+	PeakDelayUS       uint64 `json:"peak_delay_us"`
+	AvgDelayUS        uint64 `json:"avg_delay_us"`
+	BaseDelayUS       uint64 `json:"base_delay_us"`
+	SentPackets       uint64 `json:"sent_packets"`
+	Drops             uint64 `json:"drops"`
+	ECNMark           uint64 `json:"ecn_mark"`
+	AckDrops          uint64 `json:"ack_drops"`
+	SparseFlows       uint64 `json:"sparse_flows"`
+	BulkFlows         uint64 `json:"bulk_flows"`
+	UnresponsiveFlows uint64 `json:"unresponsive_flows"`
+}
+
+// Qdisc is one entry of the tc qdisc list.
+type Qdisc struct {
+	Kind       string  `json:"kind"`
+	Handle     string  `json:"handle"`
+	Parent     string  `json:"parent"`
+	Root       bool    `json:"root"`
+	Options    Options `json:"options"`
+	Bytes      uint64  `json:"bytes"`
+	Packets    uint64  `json:"packets"`
+	Drops      uint64  `json:"drops"`
+	Overlimits uint64  `json:"overlimits"`
+	Requeues   uint64  `json:"requeues"`
+	Backlog    uint64  `json:"backlog"`
+	Qlen       uint64  `json:"qlen"`
+	Tins       []Tin   `json:"tins"`
+}
+
+// Class is one entry of the tc class list.
+type Class struct {
+	Kind       string `json:"class"`
+	Handle     string `json:"handle"`
+	Parent     string `json:"parent,omitempty"`
+	Root       bool   `json:"root,omitempty"`
+	Leaf       string `json:"leaf,omitempty"`
+	Bytes      uint64 `json:"bytes"`
+	Packets    uint64 `json:"packets"`
+	Drops      uint64 `json:"drops"`
+	Overlimits uint64 `json:"overlimits"`
+	Requeues   uint64 `json:"requeues"`
+	Backlog    uint64 `json:"backlog"`
+	Qlen       uint64 `json:"qlen"`
+}
+
+// Filter is one entry of the tc filter list. Options holds the
+// classifier-specific JSON printed by tc; the netlink source leaves it empty.
+type Filter struct {
+	Parent   string          `json:"parent"`
+	Protocol string          `json:"protocol"`
+	Pref     uint32          `json:"pref"`
+	Kind     string          `json:"kind"`
+	Chain    uint32          `json:"chain"`
+	Options  json.RawMessage `json:"options,omitempty"`
+}
+
+// Root returns the root qdisc in qdiscs.
+func Root(qdiscs []Qdisc) (Qdisc, bool) {
+	for _, q := range qdiscs {
+		if q.Root {
+			return q, true
+		}
+	}
+	return Qdisc{}, false
+}
+
+// Decode parses the output of "tc -s -j qdisc show".
+func Decode(b []byte) ([]Qdisc, error) {
+	var qdiscs []Qdisc
+	if err := json.Unmarshal(b, &qdiscs); err != nil {
+		return nil, err
+	}
+	return qdiscs, nil
+}
@@ -0,0 +1,24 @@
+package tcstats
+
+import "testing"
+
+func TestDecodeUnlimitedBandwidth(t *testing.T) {
+	qdiscs, err := Decode([]byte(`[{"kind":"cake","options":{"bandwidth":"unlimited","diffserv":"diffserv3"}}]`))
+	if err != nil {
+		t.Fatalf("decode unlimited bandwidth: %v", err)
+	}
+	if qdiscs[0].Options.Bandwidth != 0 {
+		t.Fatalf("unlimited bandwidth = %d, want 0", qdiscs[0].Options.Bandwidth)
+	}
+}
+
+func TestDecodeThrottlingCounters(t *testing.T) {
+	qdiscs, err := Decode([]byte(`[{"kind":"cake","handle":"1:","bytes":10,"packets":2,"drops":1,"overlimits":7,"requeues":3,"backlog":0,"qlen":4}]`))
+	if err != nil {
+		t.Fatalf("decode qdisc: %v", err)
+	}
+	q := qdiscs[0]
+	if q.Overlimits != 7 || q.Requeues != 3 || q.Qlen != 4 || q.Packets != 2 {
+		t.Fatalf("unexpected decoded qdisc: %+v", q)
+	}
+}
@@ -65,4 +65,30 @@ assert_contains "$CREATE_OUT" "DIMENSION 'q1_bytes' 'Q1_Bytes' incremental 1 125
 assert_contains "$UPDATE_OUT" "BEGIN \"SQM.eth0_BE_traffic\" 1000000"
 assert_contains "$UPDATE_OUT" "SET 'q1_bytes' = 200"
 
+mkdir -p "$TMP/replay"
+PATH="$TMP/bin:/usr/bin:/bin" tc -s -j qdisc show dev eth0 > "$TMP/replay/eth0.qdisc.json"
+REPLAY_OUT="$(PATH="/usr/bin:/bin" "$BIN" -ifc eth0 -mode overlay -format netdata-update -microseconds 1000000 -source "replay:$TMP/replay")"
+[ "$REPLAY_OUT" = "$UPDATE_OUT" ] || fail "replay source output differs from tc output"
+
+# A queue and the diffserv4 tins disappearing between runs must obsolete their
+# charts and dimensions and define the new besteffort tin before the update.
+PATH="/usr/bin:/bin" "$BIN" -ifc eth0 -mode overlay -format netdata-create -source "replay:$TMP/replay" -plan-file "$TMP/plan" >/dev/null
+mkdir -p "$TMP/replay2"
+cat > "$TMP/replay2/eth0.qdisc.json" <<'JSON'
+[
+  {"kind":"cake_mq","handle":"1:","root":true,"bytes":1000,"drops":1,"backlog":0},
+  {"kind":"cake","handle":"10:","parent":"1:1","bytes":600,"drops":0,"backlog":0,"options":{"diffserv":"besteffort"},"tins":[
+    {"threshold_rate":1000,"sent_bytes":100,"target_us":5000,"peak_delay_us":10,"avg_delay_us":5,"base_delay_us":1,"sent_packets":10}
+  ]}
+]
+JSON
+CHANGE_OUT="$(PATH="/usr/bin:/bin" "$BIN" -ifc eth0 -mode overlay -format netdata-update -microseconds 1000000 -source "replay:$TMP/replay2" -plan-file "$TMP/plan")"
+assert_contains "$CHANGE_OUT" "CHART \"SQM.eth0_T0_traffic\""
+assert_contains "$CHANGE_OUT" "DIMENSION 'q1_bytes' 'Q1_Bytes' incremental 1 125"
+assert_contains "$CHANGE_OUT" "'obsolete'"
+assert_contains "$CHANGE_OUT" "BEGIN \"SQM.eth0_T0_traffic\" 1000000"
+[[ "$CHANGE_OUT" == *"CHART \"SQM.eth0_BE_traffic\""*"'obsolete'"* ]] || fail "expected the BE traffic chart to be obsoleted"
+AGAIN_OUT="$(PATH="/usr/bin:/bin" "$BIN" -ifc eth0 -mode overlay -format netdata-update -microseconds 1000000 -source "replay:$TMP/replay2" -plan-file "$TMP/plan")"
+[[ "$AGAIN_OUT" != *"CHART \""* ]] || fail "unchanged topology should not redefine charts"
+
 echo "sqm-go-collector-bin-test.sh: PASS"